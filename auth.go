@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ----- authentication -----
+
+// Credentials are Authorization: Bearer <jwt> (HS256 or RS256 signed by configured keys, claims sub and role,
+// exp is required) or X-API-Key: <key> (static keys of config, key:role:user_id).
+// Authenticators are tried in order, add your own to authenticators.
+// Principal is put into context, resolvers take it by principalFromContext(p.Context).
+// Invalid credentials are rejected with 401; anonymous requests are rejected if auth.required is set.
+// Websocket takes credentials from handshake headers or from connection_init payload ({"Authorization": "Bearer ..."}).
+// If authentication is not configured (playground mode), resolvers do not check roles.
+
+type Role string
+
+const (
+	RoleCustomer   Role = "customer"
+	RoleDriver     Role = "driver"
+	RoleDispatcher Role = "dispatcher"
+	RoleAdmin      Role = "admin"
+)
+
+var roles = []Role{RoleCustomer, RoleDriver, RoleDispatcher, RoleAdmin}
+
+const apiKeyHeader = "X-API-Key"
+
+type Principal struct {
+	UserId string // customer_id or driver_id for customers and drivers
+	Role   Role
+}
+
+// AuthConfig is config.Auth
+type AuthConfig struct {
+	Required bool `config:"required" env:"AUTH_REQUIRED" help:"reject anonymous requests"`
+	JWT      struct {
+		HS256Secret    string `config:"hs256_secret" env:"JWT_HS256_SECRET" secret:"true" help:"shared secret of HS256 tokens"`
+		RS256PublicKey string `config:"rs256_public_key" env:"JWT_RS256_PUBLIC_KEY" help:"PEM file with public key of RS256 tokens"`
+		Issuer         string `config:"issuer" env:"JWT_ISSUER" help:"expected iss claim, not checked if empty"`
+		Audience       string `config:"audience" env:"JWT_AUDIENCE" help:"expected aud claim, not checked if empty"`
+	} `config:"jwt"`
+	APIKeys []string `config:"api_keys" env:"API_KEYS" secret:"true" help:"static api keys, key:role:user_id"`
+}
+
+// authenticator returns nil principal if its credentials are not present
+type authenticator func(h http.Header) (*Principal, error)
+
+var authenticators []authenticator
+
+func setupAuth(c AuthConfig) error {
+	a, err := newAuthenticators(c)
+	authenticators = a
+	return err
+}
+
+// newAuthenticators is used by config validation too
+func newAuthenticators(c AuthConfig) ([]authenticator, error) {
+	result := []authenticator{}
+	keys := map[string]interface{}{} // by alg
+	if c.JWT.HS256Secret != "" {
+		keys["HS256"] = []byte(c.JWT.HS256Secret)
+	}
+	if c.JWT.RS256PublicKey != "" {
+		pem, err := os.ReadFile(c.JWT.RS256PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid RS256 public key: %w", err)
+		}
+		key, err := jwt.ParseRSAPublicKeyFromPEM(pem)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid RS256 public key %s: %w", c.JWT.RS256PublicKey, err)
+		}
+		keys["RS256"] = key
+	}
+	if len(keys) > 0 {
+		result = append(result, jwtAuthenticator(keys, c))
+	}
+	if len(c.APIKeys) > 0 {
+		principals := map[string]*Principal{}
+		for i, k := range c.APIKeys {
+			parts := strings.SplitN(k, ":", 3)
+			if len(parts) != 3 || parts[0] == "" {
+				return nil, fmt.Errorf("Invalid api key #%d, key:role:user_id is expected", i+1)
+			}
+			p, err := newPrincipal(parts[2], parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid api key #%d: %s", i+1, err.Error())
+			}
+			principals[parts[0]] = p
+		}
+		result = append(result, apiKeyAuthenticator(principals))
+	}
+	return result, nil
+}
+
+func newPrincipal(userId string, role string) (*Principal, error) {
+	for _, r := range roles {
+		if string(r) != role {
+			continue
+		}
+		if userId == "" && (r == RoleCustomer || r == RoleDriver) {
+			return nil, UnauthenticatedError("User id is required for role %s", role)
+		}
+		return &Principal{UserId: userId, Role: r}, nil
+	}
+	return nil, UnauthenticatedError("Unknown role %q", role)
+}
+
+func jwtAuthenticator(keys map[string]interface{}, c AuthConfig) authenticator {
+	algs := []string{}
+	for alg := range keys {
+		algs = append(algs, alg)
+	}
+	opts := []jwt.ParserOption{jwt.WithValidMethods(algs), jwt.WithExpirationRequired(), jwt.WithLeeway(30 * time.Second)}
+	if c.JWT.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(c.JWT.Issuer))
+	}
+	if c.JWT.Audience != "" {
+		opts = append(opts, jwt.WithAudience(c.JWT.Audience))
+	}
+	return func(h http.Header) (*Principal, error) {
+		token, ok := strings.CutPrefix(h.Get("Authorization"), "Bearer ")
+		if !ok {
+			return nil, nil
+		}
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(strings.TrimSpace(token), claims, func(t *jwt.Token) (interface{}, error) {
+			return keys[t.Method.Alg()], nil // alg is checked by WithValidMethods
+		}, opts...)
+		if err != nil {
+			return nil, UnauthenticatedError("Invalid token: %s", err.Error())
+		}
+		sub, _ := claims["sub"].(string)
+		role, _ := claims["role"].(string)
+		return newPrincipal(sub, role)
+	}
+}
+
+func apiKeyAuthenticator(principals map[string]*Principal) authenticator {
+	return func(h http.Header) (*Principal, error) {
+		key := h.Get(apiKeyHeader)
+		if key == "" {
+			return nil, nil
+		}
+		p, ok := principals[key]
+		if !ok {
+			return nil, UnauthenticatedError("Invalid api key")
+		}
+		return p, nil
+	}
+}
+
+// authenticate returns nil principal for anonymous request
+func authenticate(h http.Header) (*Principal, error) {
+	for _, a := range authenticators {
+		p, err := a(h)
+		if err != nil || p != nil {
+			return p, err
+		}
+	}
+	return nil, nil
+}
+
+func checkAuthenticated(p *Principal) error {
+	if p == nil && config.Auth.Required {
+		return UnauthenticatedError("Authentication required")
+	}
+	return nil
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	if p == nil {
+		return ctx
+	}
+	ctx = withLogAttrs(ctx, slog.String("user", p.UserId), slog.String("role", string(p.Role)))
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFromContext returns nil for anonymous request
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// withAuthentication puts principal into request; if credentials are invalid, error is sent and false is returned
+func withAuthentication(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	p, err := authenticate(r.Header)
+	if err == nil {
+		err = checkAuthenticated(p)
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gql"`)
+		writeResult(w, r, http.StatusUnauthorized, rejectedResult(r.Context(), err))
+		return r, false
+	}
+	return r.WithContext(withPrincipal(r.Context(), p)), true
+}
+
+// initPayloadHeaders takes credentials from connection_init payload of websocket
+func initPayloadHeaders(payload json.RawMessage) http.Header {
+	var values map[string]interface{}
+	json.Unmarshal(payload, &values)
+	h := http.Header{}
+	for k, v := range values {
+		if s, ok := v.(string); ok {
+			h.Set(k, s)
+		}
+	}
+	return h
+}
+
+// requireRole returns principal if it has one of roles; if authentication is not configured, nil principal is returned
+func requireRole(ctx context.Context, allowed ...Role) (*Principal, error) {
+	if len(authenticators) == 0 {
+		return nil, nil
+	}
+	p := principalFromContext(ctx)
+	if p == nil {
+		return nil, UnauthenticatedError("Authentication required")
+	}
+	for _, r := range allowed {
+		if p.Role == r {
+			return p, nil
+		}
+	}
+	return nil, ForbiddenError("Role %s is not allowed", p.Role).WithDetail("roles", allowed)
+}
+
+// ownUser checks that customer or driver acts on their own behalf
+func ownUser(p *Principal, role Role, id int) error {
+	if p != nil && p.Role == role && p.UserId != strconv.Itoa(id) {
+		return ForbiddenError("Role %s can act on its own behalf only", role).WithDetail("user_id", id)
+	}
+	return nil
+}
+
+// Read access: dispatchers and admins read everything, customers read their own data and rides,
+// drivers read their own data and rides they drive; people of a readable ride can be read by name.
+
+// restrictedPrincipal returns principal whose reads have to be checked; nil means everything can be read
+func restrictedPrincipal(ctx context.Context) (*Principal, error) {
+	p, err := requireRole(ctx, roles...)
+	if err != nil || p == nil || p.Role == RoleDispatcher || p.Role == RoleAdmin {
+		return nil, err
+	}
+	return p, nil
+}
+
+// canReadRide checks restricted principal (see restrictedPrincipal) against people of ride
+func canReadRide(p *Principal, customerId int, driverId int) bool {
+	return p == nil ||
+		p.Role == RoleCustomer && p.UserId == strconv.Itoa(customerId) ||
+		p.Role == RoleDriver && p.UserId == strconv.Itoa(driverId)
+}
+
+// requireSelf allows customer or driver to read their own rides, vehicles and so on
+func requireSelf(ctx context.Context, role Role, id int) error {
+	p, err := restrictedPrincipal(ctx)
+	if err != nil || p == nil {
+		return err
+	}
+	if p.Role != role || p.UserId != strconv.Itoa(id) {
+		return ForbiddenError("Data of %s %d is not available", role, id).WithDetail("user_id", id)
+	}
+	return nil
+}
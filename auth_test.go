@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func withAuthenticators(t *testing.T) {
+	prev := authenticators
+	authenticators = []authenticator{func(h http.Header) (*Principal, error) { return nil, nil }}
+	t.Cleanup(func() { authenticators = prev })
+}
+
+func TestReadAccess(t *testing.T) {
+	withAuthenticators(t)
+	customer := &Principal{UserId: "200", Role: RoleCustomer}
+	driver := &Principal{UserId: "1", Role: RoleDriver}
+	dispatcher := &Principal{UserId: "7", Role: RoleDispatcher}
+	for _, c := range []struct {
+		name      string
+		principal *Principal
+		role      Role
+		id        int
+		code      ErrorCode // of requireSelf, empty if allowed
+	}{
+		{"anonymous", nil, RoleCustomer, 200, CodeUnauthenticated},
+		{"own customer", customer, RoleCustomer, 200, ""},
+		{"other customer", customer, RoleCustomer, 201, CodeForbidden},
+		{"customer reads driver", customer, RoleDriver, 200, CodeForbidden},
+		{"own driver", driver, RoleDriver, 1, ""},
+		{"driver reads customer", driver, RoleCustomer, 1, CodeForbidden},
+		{"dispatcher", dispatcher, RoleCustomer, 201, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := requireSelf(withPrincipal(context.Background(), c.principal), c.role, c.id)
+			var e *Error
+			if c.code == "" && err != nil || c.code != "" && (!errors.As(err, &e) || e.Code != c.code) {
+				t.Errorf("requireSelf = %v, want %q", err, c.code)
+			}
+		})
+	}
+
+	if !canReadRide(customer, 200, 1) || canReadRide(customer, 201, 1) {
+		t.Error("customer reads rides of others")
+	}
+	if !canReadRide(driver, 201, 1) || canReadRide(driver, 200, 2) {
+		t.Error("driver reads rides of others")
+	}
+	if p, _ := restrictedPrincipal(withPrincipal(context.Background(), dispatcher)); p != nil {
+		t.Error("dispatcher reads are restricted")
+	}
+}
+
+func TestReadAccessWithoutAuthentication(t *testing.T) {
+	prev := authenticators
+	authenticators = nil
+	t.Cleanup(func() { authenticators = prev })
+	if err := requireSelf(context.Background(), RoleCustomer, 200); err != nil {
+		t.Errorf("playground mode is restricted: %v", err)
+	}
+}
+
+func TestStatsAccess(t *testing.T) {
+	withAuthenticators(t)
+	schema := serviceSchema(t)
+	for _, c := range []struct {
+		name      string
+		principal *Principal
+		want      string
+	}{
+		{"customer", &Principal{UserId: "100", Role: RoleCustomer}, `"code":"FORBIDDEN"`},
+		{"driver", &Principal{UserId: "1", Role: RoleDriver}, `"code":"FORBIDDEN"`},
+		{"dispatcher", &Principal{UserId: "7", Role: RoleDispatcher}, `"totalRides":3`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := execute(schema, c.principal, "{ stats { totalRides topDestinations { destination } } }"); !strings.Contains(got, c.want) {
+				t.Errorf("result %s, want %s", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/graph-gophers/dataloader"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// ----- batched operations -----
+
+// apollo-link-batch-http: POST with json array of operations, response is json array of results in the same order.
+// All operations share loaders. Queries are executed concurrently, so their loads are batched together.
+// If batch contains mutation, operations are executed one by one in order, loader caches are dropped after mutations.
+
+type batchOperation struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+	Extensions    map[string]interface{} `json:"extensions"`
+}
+
+func isBatchRequest(r *http.Request) bool {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return false
+	}
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return bytes.HasPrefix(bytes.TrimLeft(body, " \t\r\n"), []byte("["))
+}
+
+func serveBatch(schema *graphql.Schema, w http.ResponseWriter, r *http.Request) {
+	var operations []batchOperation
+	if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+		writeResult(w, r, http.StatusBadRequest, rejectedResult(r.Context(), ValidationError("Invalid batch: %s", err.Error())))
+		return
+	}
+	if max := config.Limits.MaxBatchSize; len(operations) == 0 || (max > 0 && len(operations) > max) {
+		writeResult(w, r, http.StatusBadRequest, rejectedResult(r.Context(),
+			ValidationError("Batch must contain from 1 to %d operations", config.Limits.MaxBatchSize).WithDetail("size", len(operations))))
+		return
+	}
+	setOperationLabels(r.Context(), "", "batch")
+	loaders := NewLoaders()
+	ctx := context.WithValue(r.Context(), "dataloaders", loaders)
+	results := make([]*graphql.Result, len(operations))
+	mutations := make([]bool, len(operations))
+	sequential := false
+	for i := range operations {
+		o := &operations[i]
+		query, err := persisted.resolve(o.Query, o.Extensions)
+		if err == nil {
+			err = checkQueryLimits(schema, query, o.OperationName, o.Variables)
+		}
+		if err != nil {
+			results[i] = rejectedResult(ctx, err)
+			continue
+		}
+		o.Query = query
+		if t, _ := operationType(query, o.OperationName); t == ast.OperationTypeMutation {
+			mutations[i] = true
+			sequential = true
+		}
+	}
+	var wg sync.WaitGroup
+	for i, o := range operations {
+		if results[i] != nil {
+			continue
+		}
+		wg.Add(1)
+		run := func(i int, o batchOperation) {
+			defer wg.Done()
+			defer recoverGoroutine(ctx, "panic in batched operation", func() { results[i] = internalErrorResult(ctx) })
+			results[i] = executeQuery(graphql.Params{
+				Schema:         *schema,
+				RequestString:  o.Query,
+				VariableValues: o.Variables,
+				OperationName:  o.OperationName,
+				Context:        ctx,
+			})
+		}
+		if sequential {
+			run(i, o)
+			if mutations[i] {
+				clearLoaders(loaders) // next operations have to see changes
+			}
+		} else {
+			go run(i, o)
+		}
+	}
+	wg.Wait()
+	writeResult(w, r, http.StatusOK, results)
+}
+
+func clearLoaders(loaders map[string]*dataloader.Loader) {
+	for _, l := range loaders {
+		l.ClearAll()
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ----- configuration -----
+
+// Settings are taken from (every next source overrides previous one):
+// defaults (defaultConfig), config file (-config flag or CONFIG_FILE, .yaml/.yml or .toml),
+// environment (env tags) and flags (dotted keys: -log.format=json, -limits.max_depth=8).
+// Config is validated on start; `config print` prints effective config with secrets redacted.
+// Subsystems take their settings from config (sections are defined next to subsystems: LogConfig, QueryLimits, HTTPCacheConfig,
+// SubscriptionsConfig).
+
+type Config struct {
+	Listen        string          `config:"listen" env:"LISTEN" help:"address to listen on"`
+	Timeouts      TimeoutsConfig  `config:"timeouts"`
+	Env           string          `config:"env" env:"ENV" help:"development or production (internal errors are masked)"`
+	Database      string          `config:"database" env:"DATABASE" help:"sqlite database file"`
+	DocumentCache int             `config:"document_cache_size" help:"parsed and validated documents kept in cache"`
+	Compression   int             `config:"compression_threshold" help:"responses from this size (bytes) are compressed"`
+	GraphiQL      bool            `config:"graphiql" env:"GRAPHIQL" help:"serve GraphiQL to browsers"`
+	Playground    bool            `config:"playground" env:"PLAYGROUND" help:"serve GraphQL Playground to browsers (if GraphiQL is off)"`
+	ApolloTracing bool            `config:"apollo_tracing" env:"APOLLO_TRACING" help:"allow X-Apollo-Tracing in production (always allowed in development)"`
+	CORS          CORSConfig      `config:"cors"`
+	Auth          AuthConfig      `config:"auth"`
+	Log           LogConfig       `config:"log"`
+	Limits        QueryLimits     `config:"limits"`
+	HTTPCache     HTTPCacheConfig `config:"http_cache"`
+	Persisted     struct {
+		Manifest  string `config:"manifest" env:"PERSISTED_QUERIES_MANIFEST" help:"manifest of allowed operations, turns allowlist mode on"`
+		CacheSize int    `config:"cache_size" help:"queries registered by clients kept in memory"`
+	} `config:"persisted_queries"`
+	Subscriptions SubscriptionsConfig `config:"subscriptions"`
+	Telemetry     struct {
+		TracesExporter string `config:"traces_exporter" env:"TRACES_EXPORTER" help:"stdout or file:path; traces are off if empty"`
+	} `config:"telemetry"`
+}
+
+// config is effective configuration, main() loads it
+var config = defaultConfig()
+
+func defaultConfig() *Config {
+	c := &Config{
+		Listen:        ":8080",
+		Timeouts:      TimeoutsConfig{Read: 10 * time.Second, Write: 30 * time.Second, Idle: 2 * time.Minute, Shutdown: 30 * time.Second},
+		Env:           "development",
+		Database:      "database.db",
+		DocumentCache: 1000,
+		Compression:   1024,
+		GraphiQL:      true,
+		Playground:    true,
+		CORS:          defaultCORSConfig(),
+		Log:           LogConfig{Format: "pretty", Level: "info"},
+		Limits:        QueryLimits{MaxDepth: 12, MaxCost: 10000, DefaultListSize: 10, MaxBatchSize: 32},
+		HTTPCache:     defaultHTTPCacheConfig(),
+		Subscriptions: SubscriptionsConfig{HistorySize: 256, SSEHeartbeat: 12 * time.Second, WSInitTimeout: 3 * time.Second, WSWriteTimeout: 5 * time.Second},
+	}
+	c.Persisted.CacheSize = 1000
+	return c
+}
+
+// configField is leaf of config
+type configField struct {
+	key    string // dotted path, it is name of flag too
+	env    string
+	help   string
+	secret bool
+	value  reflect.Value
+}
+
+func (c *Config) fields() []configField {
+	fields := []configField{}
+	var walk func(v reflect.Value, prefix string)
+	walk = func(v reflect.Value, prefix string) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			key := prefix + f.Tag.Get("config")
+			if f.Type.Kind() == reflect.Struct {
+				walk(v.Field(i), key+".")
+				continue
+			}
+			fields = append(fields, configField{
+				key:    key,
+				env:    f.Tag.Get("env"),
+				help:   f.Tag.Get("help"),
+				secret: f.Tag.Get("secret") == "true",
+				value:  v.Field(i),
+			})
+		}
+	}
+	walk(reflect.ValueOf(c).Elem(), "")
+	return fields
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses value of flag or environment variable; lists are comma separated
+func (f configField) set(s string) error {
+	v := f.value
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("Invalid %s %q: %w", f.key, s, err)
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("Invalid %s %q: %w", f.key, s, err)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("Invalid %s %q: %w", f.key, s, err)
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Slice:
+		items := []string{}
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		panic("unsupported config field " + f.key)
+	}
+	return nil
+}
+
+// loadConfig applies config file, environment and flags (args without program name) to defaults
+func loadConfig(args []string) (*Config, error) {
+	c := defaultConfig()
+	fields := c.fields()
+	flags := flag.NewFlagSet("playground-graphql-go", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv("CONFIG_FILE"), "config file, yaml or toml (env CONFIG_FILE)")
+	type override struct {
+		field configField
+		value string
+	}
+	overrides := []override{} // flags are applied after file and environment
+	for _, f := range fields {
+		f := f
+		usage := f.help
+		if f.env != "" {
+			usage += " (env " + f.env + ")"
+		}
+		add := func(s string) error {
+			overrides = append(overrides, override{f, s})
+			return nil
+		}
+		if f.value.Kind() == reflect.Bool {
+			flags.BoolFunc(f.key, usage, add)
+		} else {
+			flags.Func(f.key, usage, add)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	if *path != "" {
+		if err := c.loadFile(*path, fields); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range fields {
+		if s, ok := os.LookupEnv(f.env); f.env != "" && ok {
+			if err := f.set(s); err != nil {
+				return nil, fmt.Errorf("%w (env %s)", err, f.env)
+			}
+		}
+	}
+	for _, o := range overrides {
+		if err := o.field.set(o.value); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string, fields []configField) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return fmt.Errorf("Unknown format of config file %s, yaml or toml is expected", path)
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid config file %s: %w", path, err)
+	}
+	values := map[string]string{}
+	flattenConfig(raw, "", values)
+	byKey := map[string]configField{}
+	for _, f := range fields {
+		byKey[f.key] = f
+	}
+	for key, value := range values {
+		f, ok := byKey[key]
+		if !ok {
+			return fmt.Errorf("Invalid config file %s: unknown key %s", path, key)
+		}
+		if err := f.set(value); err != nil {
+			return fmt.Errorf("Invalid config file %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// flattenConfig turns nested maps into dotted keys and values into strings the way flags look like
+func flattenConfig(raw map[string]interface{}, prefix string, values map[string]string) {
+	for k, v := range raw {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			flattenConfig(v, prefix+k+".", values)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[prefix+k] = strings.Join(items, ",")
+		default:
+			values[prefix+k] = fmt.Sprint(v)
+		}
+	}
+}
+
+// validate reports all problems at once
+func (c *Config) validate() error {
+	errs := []error{}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		fail("Invalid listen address %q: %w", c.Listen, err)
+	}
+	if c.Timeouts.Read < 0 || c.Timeouts.Write < 0 || c.Timeouts.Idle < 0 || c.Timeouts.Drain < 0 || c.Timeouts.Shutdown <= 0 {
+		fail("Timeouts can not be negative, shutdown timeout has to be set")
+	}
+	if c.Env != "development" && c.Env != "production" {
+		fail("Invalid env %q, development or production is expected", c.Env)
+	}
+	if c.Database == "" {
+		fail("Database is not set")
+	}
+	if c.DocumentCache <= 0 || c.Persisted.CacheSize <= 0 {
+		fail("Sizes of document and persisted query caches have to be positive")
+	}
+	if c.Compression < 0 {
+		fail("Compression threshold can not be negative")
+	}
+	if err := c.CORS.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newAuthenticators(c.Auth); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Log.Format != "pretty" && c.Log.Format != "json" {
+		fail("Unknown log format %q", c.Log.Format)
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		fail("Invalid log level %q: %w", c.Log.Level, err)
+	}
+	if c.Limits.MaxDepth < 0 || c.Limits.MaxCost < 0 || c.Limits.DefaultListSize < 0 || c.Limits.MaxBatchSize < 0 {
+		fail("Query limits can not be negative")
+	}
+	if c.HTTPCache.DefaultMaxAge < 0 {
+		fail("Default max age of http cache can not be negative")
+	}
+	if _, err := parseCacheHints(c.HTTPCache.Hints); err != nil {
+		errs = append(errs, err)
+	}
+	if m := c.Persisted.Manifest; m != "" {
+		if _, err := os.Stat(m); err != nil {
+			fail("Invalid persisted queries manifest: %w", err)
+		}
+	}
+	if err := c.Subscriptions.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if spec := c.Telemetry.TracesExporter; spec != "" {
+		if _, ok := traceExporters[strings.SplitN(spec, ":", 2)[0]]; !ok {
+			fail("Unknown traces exporter %q", spec)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// print writes effective config as yaml, it can be used as config file
+func (c *Config) print(w io.Writer) error {
+	out := map[string]interface{}{}
+	for _, f := range c.fields() {
+		v := f.value.Interface()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		if f.secret && !f.value.IsZero() && !(f.value.Kind() == reflect.Slice && f.value.Len() == 0) {
+			v = "REDACTED"
+		}
+		m := out
+		path := strings.Split(f.key, ".")
+		for _, k := range path[:len(path)-1] {
+			if _, ok := m[k]; !ok {
+				m[k] = map[string]interface{}{}
+			}
+			m = m[k].(map[string]interface{})
+		}
+		m[path[len(path)-1]] = v
+	}
+	b, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----- cors -----
+
+// Browsers may call api from allowed origins only: exact ("https://app.example.com"),
+// any subdomain ("https://*.example.com", apex domain is not matched) or any ("*", credentials are not allowed then).
+// Preflight (OPTIONS with Access-Control-Request-Method) is answered here, it is cached by browser for max_age.
+// Response depends on Origin, so it always gets Vary: Origin.
+// Websockets are not restricted by browsers, upgrader checks Origin by the same allowlist.
+
+// CORSConfig is config.CORS
+type CORSConfig struct {
+	Origins     []string      `config:"origins" env:"CORS_ORIGINS" help:"origins allowed to call api: https://app.example.com, https://*.example.com or *"`
+	Credentials bool          `config:"credentials" env:"CORS_CREDENTIALS" help:"allow cookies and authorization of browser"`
+	Methods     []string      `config:"methods" help:"methods allowed to be sent from browser"`
+	Headers     []string      `config:"headers" help:"headers allowed to be sent from browser"`
+	MaxAge      time.Duration `config:"max_age" help:"browser caches preflight response for"`
+}
+
+var corsExposeHeaders = requestIdHeader + ",ETag"
+
+func defaultCORSConfig() CORSConfig {
+	return CORSConfig{
+		Origins: []string{}, // same origin only
+		Methods: []string{http.MethodGet, http.MethodPost},
+		Headers: []string{"Content-Type", "X-Apollo-Tracing", "Last-Event-ID", "X-Request-ID", "If-None-Match", "traceparent", "tracestate", "Authorization", apiKeyHeader},
+		MaxAge:  10 * time.Minute,
+	}
+}
+
+func (c CORSConfig) validate() error {
+	for _, o := range c.Origins {
+		if o == "*" {
+			if c.Credentials {
+				return fmt.Errorf("Any cors origin (*) can not be allowed with credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(o, "://*.", "://wildcard.", 1))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") ||
+			strings.Contains(u.Host, "*") || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("Invalid cors origin %q", o)
+		}
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("Invalid cors max age %s", c.MaxAge)
+	}
+	return nil
+}
+
+// matchOrigin checks origin against one pattern of allowlist
+func matchOrigin(pattern string, origin string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	if pattern == "*" || strings.EqualFold(pattern, origin) {
+		return true
+	}
+	i := strings.Index(pattern, "://*.")
+	if i < 0 {
+		return false
+	}
+	prefix, suffix := strings.ToLower(pattern[:i+3]), strings.ToLower(pattern[i+4:]) // "https://", ".example.com"
+	origin = strings.ToLower(origin)
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return sub != "" && !strings.ContainsAny(sub, "/:@")
+}
+
+func originAllowed(origin string) bool {
+	for _, o := range config.CORS.Origins {
+		if matchOrigin(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyOriginAllowed() bool {
+	for _, o := range config.CORS.Origins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin: browser sends Origin for same origin posts too
+func sameOrigin(r *http.Request) bool {
+	u, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+func allowedHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		found := false
+		for _, a := range config.CORS.Headers {
+			found = found || strings.EqualFold(a, h)
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func allowedMethod(method string) bool {
+	for _, m := range config.CORS.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS sets cors headers; preflight is answered, true is returned then
+func withCORS(w http.ResponseWriter, r *http.Request) bool {
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	method := r.Header.Get("Access-Control-Request-Method")
+	preflight := r.Method == http.MethodOptions && origin != "" && method != ""
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if origin == "" || !originAllowed(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusNoContent) // without cors headers, browser rejects request
+		}
+		return preflight
+	}
+	if anyOriginAllowed() {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if config.CORS.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		return false
+	}
+	if allowedMethod(method) && allowedHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+		h.Set("Access-Control-Allow-Methods", strings.Join(config.CORS.Methods, ","))
+		h.Set("Access-Control-Allow-Headers", strings.Join(config.CORS.Headers, ","))
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(config.CORS.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// checkWebSocketOrigin allows non-browser clients, same origin and allowed origins
+func checkWebSocketOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || sameOrigin(r) || originAllowed(origin)
+}
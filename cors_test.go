@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func withCORSConfig(t *testing.T, c CORSConfig) {
+	prev := config.CORS
+	config.CORS = c
+	t.Cleanup(func() { config.CORS = prev })
+}
+
+func TestWithCORS(t *testing.T) {
+	allowlist := defaultCORSConfig()
+	allowlist.Origins = []string{"https://app.example.com", "https://*.example.org"}
+	credentials := allowlist
+	credentials.Credentials = true
+	anyOrigin := defaultCORSConfig()
+	anyOrigin.Origins = []string{"*"}
+	for _, c := range []struct {
+		name          string
+		config        CORSConfig
+		method        string
+		headers       map[string]string
+		answered      bool   // preflight is answered by withCORS
+		allowOrigin   string // expected Access-Control-Allow-Origin, empty means absent
+		allowMethods  bool   // Access-Control-Allow-Methods is set
+		allowCreds    bool
+		varyPreflight bool
+	}{
+		{
+			name: "allowed origin", config: allowlist, method: "POST",
+			headers:     map[string]string{"Origin": "https://app.example.com"},
+			allowOrigin: "https://app.example.com",
+		},
+		{
+			name: "allowed subdomain", config: allowlist, method: "GET",
+			headers:     map[string]string{"Origin": "https://a.example.org"},
+			allowOrigin: "https://a.example.org",
+		},
+		{
+			name: "apex of wildcard", config: allowlist, method: "POST",
+			headers: map[string]string{"Origin": "https://example.org"},
+		},
+		{
+			name: "disallowed origin", config: allowlist, method: "POST",
+			headers: map[string]string{"Origin": "https://evil.com"},
+		},
+		{
+			name: "suffix trick", config: allowlist, method: "POST",
+			headers: map[string]string{"Origin": "https://app.example.com.evil.com"},
+		},
+		{
+			name: "no origin", config: allowlist, method: "POST",
+		},
+		{
+			name: "any origin", config: anyOrigin, method: "POST",
+			headers:     map[string]string{"Origin": "https://evil.com"},
+			allowOrigin: "*",
+		},
+		{
+			name: "credentials", config: credentials, method: "POST",
+			headers:     map[string]string{"Origin": "https://app.example.com"},
+			allowOrigin: "https://app.example.com", allowCreds: true,
+		},
+		{
+			name: "preflight", config: allowlist, method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  "POST",
+				"Access-Control-Request-Headers": "content-type, authorization",
+			},
+			answered: true, allowOrigin: "https://app.example.com", allowMethods: true, varyPreflight: true,
+		},
+		{
+			name: "preflight with credentials", config: credentials, method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": "POST",
+			},
+			answered: true, allowOrigin: "https://app.example.com", allowMethods: true, allowCreds: true, varyPreflight: true,
+		},
+		{
+			name: "preflight with header not allowed", config: allowlist, method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                         "https://app.example.com",
+				"Access-Control-Request-Method":  "POST",
+				"Access-Control-Request-Headers": "Content-Type, X-Custom",
+			},
+			answered: true, allowOrigin: "https://app.example.com", varyPreflight: true,
+		},
+		{
+			name: "preflight with method not allowed", config: allowlist, method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                        "https://app.example.com",
+				"Access-Control-Request-Method": "DELETE",
+			},
+			answered: true, allowOrigin: "https://app.example.com", varyPreflight: true,
+		},
+		{
+			name: "preflight from disallowed origin", config: allowlist, method: "OPTIONS",
+			headers: map[string]string{
+				"Origin":                        "https://evil.com",
+				"Access-Control-Request-Method": "POST",
+			},
+			answered: true, varyPreflight: true,
+		},
+		{
+			name: "options without preflight", config: allowlist, method: "OPTIONS",
+			headers:     map[string]string{"Origin": "https://app.example.com"},
+			allowOrigin: "https://app.example.com",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			withCORSConfig(t, c.config)
+			r := httptest.NewRequest(c.method, "http://api.example.net/gql", nil)
+			for k, v := range c.headers {
+				r.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			if answered := withCORS(w, r); answered != c.answered {
+				t.Fatalf("answered = %v, want %v", answered, c.answered)
+			}
+			h := w.Result().Header
+			if c.answered && w.Code != http.StatusNoContent {
+				t.Errorf("preflight status %d, want %d", w.Code, http.StatusNoContent)
+			}
+			if got := h.Get("Access-Control-Allow-Origin"); got != c.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, c.allowOrigin)
+			}
+			if got := h.Get("Access-Control-Allow-Methods") != ""; got != c.allowMethods {
+				t.Errorf("Access-Control-Allow-Methods %q", h.Get("Access-Control-Allow-Methods"))
+			}
+			if c.allowMethods && h.Get("Access-Control-Allow-Headers") == "" {
+				t.Error("no Access-Control-Allow-Headers")
+			}
+			if got := h.Get("Access-Control-Allow-Credentials") == "true"; got != c.allowCreds {
+				t.Errorf("Access-Control-Allow-Credentials %q", h.Get("Access-Control-Allow-Credentials"))
+			}
+			vary := h.Values("Vary")
+			if !slices.Contains(vary, "Origin") {
+				t.Errorf("Vary %v has no Origin", vary)
+			}
+			if got := slices.Contains(vary, "Access-Control-Request-Headers"); got != c.varyPreflight {
+				t.Errorf("Vary %v", vary)
+			}
+			if c.allowOrigin != "" && !c.answered && h.Get("Access-Control-Expose-Headers") == "" {
+				t.Error("no Access-Control-Expose-Headers")
+			}
+		})
+	}
+}
+
+func TestCORSConfigValidate(t *testing.T) {
+	for _, c := range []struct {
+		origins     []string
+		credentials bool
+		ok          bool
+	}{
+		{[]string{"https://app.example.com", "https://*.example.com", "http://localhost:3000"}, true, true},
+		{[]string{"*"}, false, true},
+		{[]string{"*"}, true, false},
+		{[]string{"app.example.com"}, false, false},
+		{[]string{"https://app.example.com/path"}, false, false},
+		{[]string{"https://*"}, false, false},
+		{[]string{"ftp://example.com"}, false, false},
+	} {
+		cfg := defaultCORSConfig()
+		cfg.Origins, cfg.Credentials = c.origins, c.credentials
+		if err := cfg.validate(); (err == nil) != c.ok {
+			t.Errorf("origins %v, credentials %v: error %v", c.origins, c.credentials, err)
+		}
+	}
+}
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	cfg := defaultCORSConfig()
+	cfg.Origins = []string{"https://app.example.com"}
+	withCORSConfig(t, cfg)
+	for origin, want := range map[string]bool{
+		"":                        true, // not a browser
+		"http://api.example.net":  true, // same origin
+		"https://app.example.com": true,
+		"https://evil.com":        false,
+	} {
+		r := httptest.NewRequest("GET", "http://api.example.net/gql", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if got := checkWebSocketOrigin(r); got != want {
+			t.Errorf("origin %q: %v, want %v", origin, got, want)
+		}
+	}
+}
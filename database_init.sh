@@ -2,8 +2,11 @@
 
 cat <<__END__ | sqlite3 database.db
 PRAGMA foreign_keys=ON;
+PRAGMA user_version=1; -- schema below includes migration 1 (vehicles), see migrations.go
 BEGIN TRANSACTION;
+DROP TABLE IF EXISTS RideSearch;
 DROP TABLE IF EXISTS Ride;
+DROP TABLE IF EXISTS Vehicle;
 DROP TABLE IF EXISTS Driver;
 DROP TABLE IF EXISTS Customer;
 CREATE TABLE Driver (
@@ -16,13 +19,26 @@ CREATE TABLE Customer (
   name string);
 insert INTO Customer VALUES(100,'Customer_100');
 insert INTO Customer VALUES(200,'Customer_200');
+CREATE TABLE Vehicle (
+  vehicle_id integer primary key autoincrement,
+  driver_id integer references Driver,
+  plate text unique,
+  make text,
+  model text,
+  seats integer,
+  class text,
+  retired integer default 0);
+insert INTO Vehicle VALUES(10,1,'A001AA','Skoda','Octavia',4,'comfort',0);
+insert INTO Vehicle VALUES(11,1,'A002AA','Ford','Transit',8,'van',0);
+insert INTO Vehicle VALUES(20,2,'B001BB','Kia','Rio',4,'economy',0);
 CREATE TABLE Ride (
   ride_id integer primary key autoincrement,
   driver_id integer references Driver,
   customer_id integer references Customer,
-  destination string);
-insert INTO Ride VALUES(1,1,100,'Adderss_for_ride_1');
-insert INTO Ride VALUES(2,1,200,'Address_for_ride_2');
-insert INTO Ride VALUES(3,2,200,'Address_for_ride_3');
+  destination string,
+  vehicle_id integer references Vehicle);
+insert INTO Ride VALUES(1,1,100,'Adderss_for_ride_1',10);
+insert INTO Ride VALUES(2,1,200,'Address_for_ride_2',11);
+insert INTO Ride VALUES(3,2,200,'Address_for_ride_3',NULL);
 COMMIT;
 __END__
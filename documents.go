@@ -0,0 +1,201 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// ----- document cache -----
+
+// executeQuery is graphql.Do, but parsed and validated documents are taken from LRU cache.
+// Key is schema version and hash of query text. Documents with parse or validation errors are not cached.
+// Extensions are called the same way as graphql.Do calls them; on cache hit there are no parsing and validation phases.
+// Parsed (not yet validated) documents are cached too, see parsedDocument: request is checked
+// (limits, cache policy, operation type...) before execution, and every check takes the same document.
+
+type documentCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List // of keys, the most recently used is at front
+	items map[string]*list.Element
+}
+
+type documentCacheItem struct {
+	key string
+	doc *ast.Document
+}
+
+// documents is replaced on start, when size is configured
+var documents = newDocumentCache(config.DocumentCache)
+
+// schemaExtensions are extensions of schema, graphql.Schema does not expose them
+var schemaExtensions []graphql.Extension
+
+// schemaVersion is set on startup, see schemaHash
+var schemaVersion = ""
+
+func newDocumentCache(size int) *documentCache {
+	return &documentCache{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// get returns document of the first key found and that key
+func (c *documentCache) get(keys ...string) (*ast.Document, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if e, ok := c.items[key]; ok {
+			c.order.MoveToFront(e)
+			return e.Value.(*documentCacheItem).doc, key, true
+		}
+	}
+	return nil, "", false
+}
+
+func (c *documentCache) put(key string, doc *ast.Document) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok { // concurrent miss
+		c.order.MoveToFront(e)
+		return
+	}
+	c.items[key] = c.order.PushFront(&documentCacheItem{key: key, doc: doc})
+	if c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.items, last.Value.(*documentCacheItem).key)
+	}
+}
+
+// schemaHash identifies schema by its introspection
+func schemaHash(schema graphql.Schema) string {
+	result := graphql.Do(graphql.Params{Schema: schema, RequestString: introspectionQuery, Context: context.Background()})
+	b, _ := json.Marshal(result.Data)
+	return queryHash(string(b))
+}
+
+const introspectionQuery = `{__schema{
+	queryType{name} mutationType{name} subscriptionType{name}
+	types{kind name fields{name args{name type{...T}} type{...T}} inputFields{name type{...T}} interfaces{name} enumValues{name} possibleTypes{name}}
+	directives{name locations args{name type{...T}}}
+}}
+fragment T on __Type {kind name ofType{kind name ofType{kind name ofType{kind name}}}}`
+
+// documentKeys are keys of validated (against current schema) and parsed document
+func documentKeys(query string) (validated string, parsed string) {
+	hash := queryHash(query)
+	return schemaVersion + ":" + hash, "parsed:" + hash
+}
+
+// parse parses query and caches document as parsed, it is not validated
+func parse(query string, key string) (*ast.Document, error) {
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{
+		Body: []byte(query),
+		Name: "GraphQL request",
+	})})
+	if err != nil {
+		return nil, err
+	}
+	documents.put(key, doc)
+	return doc, nil
+}
+
+// parsedDocument returns parsed document, it is not validated
+func parsedDocument(query string) (*ast.Document, error) {
+	validated, parsed := documentKeys(query)
+	if doc, _, ok := documents.get(validated, parsed); ok { // validated one is parsed too
+		return doc, nil
+	}
+	return parse(query, parsed)
+}
+
+// validDocument is document() for checks before execution, extensions are not called
+func validDocument(schema *graphql.Schema, query string) (*ast.Document, bool) {
+	validated, parsed := documentKeys(query)
+	doc, key, ok := documents.get(validated, parsed)
+	if key == validated {
+		return doc, true
+	}
+	if !ok {
+		var err error
+		if doc, err = parse(query, parsed); err != nil {
+			return nil, false
+		}
+	}
+	if !graphql.ValidateDocument(schema, doc, nil).IsValid {
+		return nil, false
+	}
+	documents.put(validated, doc)
+	return doc, true
+}
+
+// document returns parsed and validated document; it is the only lookup counted by metrics,
+// checks before execution take the same document and they would count every request several times
+func document(p *graphql.Params) (*ast.Document, []gqlerrors.FormattedError) {
+	validated, parsed := documentKeys(p.RequestString)
+	doc, key, ok := documents.get(validated, parsed)
+	if key == validated {
+		documentCacheRequests.WithLabelValues("hit").Inc()
+		return doc, nil
+	}
+	documentCacheRequests.WithLabelValues("miss").Inc() // parsed one is to be validated still
+	parseFinishers := []graphql.ParseFinishFunc{}
+	for _, e := range schemaExtensions {
+		var f graphql.ParseFinishFunc
+		p.Context, f = e.ParseDidStart(p.Context)
+		parseFinishers = append(parseFinishers, f)
+	}
+	var err error
+	if !ok {
+		doc, err = parse(p.RequestString, parsed)
+	}
+	for _, f := range parseFinishers {
+		f(err)
+	}
+	if err != nil {
+		errs := gqlerrors.FormatErrors(err) // finishers of extensions get error only, so classified here
+		classifyErrors(p.Context, errs, CodeGraphQLParseFailed)
+		addRequestId(p.Context, errs)
+		return nil, errs
+	}
+	validationFinishers := []graphql.ValidationFinishFunc{}
+	for _, e := range schemaExtensions {
+		var f graphql.ValidationFinishFunc
+		p.Context, f = e.ValidationDidStart(p.Context)
+		validationFinishers = append(validationFinishers, f)
+	}
+	validation := graphql.ValidateDocument(&p.Schema, doc, nil)
+	for _, f := range validationFinishers {
+		f(validation.Errors)
+	}
+	if !validation.IsValid {
+		return nil, validation.Errors
+	}
+	documents.put(validated, doc)
+	return doc, nil
+}
+
+func executeQuery(p graphql.Params) *graphql.Result {
+	for _, e := range schemaExtensions {
+		p.Context = e.Init(p.Context, &p)
+	}
+	doc, errs := document(&p)
+	if errs != nil {
+		return &graphql.Result{Errors: errs}
+	}
+	return graphql.Execute(graphql.ExecuteParams{
+		Schema:        p.Schema,
+		Root:          p.RootObject,
+		AST:           doc,
+		OperationName: p.OperationName,
+		Args:          p.VariableValues,
+		Context:       p.Context,
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// benchmarkQueries are queries of examples printed on startup
+var benchmarkQueries = []string{
+	`query { x_ride(id:2) {id destination customer {id name} driver {id name}} }`,
+	`query { x_ride(id: 3) {id destination customer {id name rides {id driver {name rides {id}}}}} }`,
+	`query { x_rides(ids:[1 2 3]){id vehicle{plate class} driver{name vehicles{plate retired}}} }`,
+	`query { x_rides(ids:[1 2 3]){driver{name ridesCount} customer{name ridesCount}} }`,
+	`query { search(text:"_2"){__typename ...on Person{id name} ...on Ride{id destination}} }`,
+	`query { searchRides(query:"addr*" first:2){edges{cursor score snippet node{id customer{name}}} pageInfo{hasNextPage endCursor}} }`,
+	`query { stats{totalRides topDestinations(limit:2){destination ridesCount} busiestDrivers(limit:1){name ridesCount}} }`,
+}
+
+// BenchmarkExecuteQuery compares execution of example queries: cold ones are parsed and validated, warm ones are taken from cache;
+// time of both is mostly batch window of dataloaders, the gain is in B/op and allocs/op
+func BenchmarkExecuteQuery(b *testing.B) {
+	schema := serviceSchema(b)
+	admin := &Principal{Role: RoleAdmin}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.DiscardHandler)) // sql is logged on every request
+	b.Cleanup(func() { slog.SetDefault(prev) })
+	run := func(b *testing.B, query func(i int, q string) string) {
+		for _, q := range benchmarkQueries {
+			if r := execute(schema, admin, q); strings.Contains(r, `"errors"`) {
+				b.Fatalf("%s: %s", q, r)
+			}
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, q := range benchmarkQueries {
+				execute(schema, admin, query(i, q))
+			}
+		}
+	}
+	b.Run("cold", func(b *testing.B) {
+		run(b, func(i int, q string) string { return q + " # " + strconv.Itoa(i) }) // unique text, the same document
+	})
+	b.Run("warm", func(b *testing.B) {
+		run(b, func(_ int, q string) string { return q })
+	})
+}
+
+func TestParsedDocumentIsShared(t *testing.T) {
+	prev := documents
+	documents = newDocumentCache(10)
+	t.Cleanup(func() { documents = prev })
+	a, err := parsedDocument(benchmarkQueries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := parsedDocument(benchmarkQueries[0])
+	if a != b {
+		t.Error("query is parsed twice")
+	}
+	if _, err := parsedDocument("{x_ride(id: 1) {id}"); err == nil {
+		t.Error("invalid query is parsed")
+	}
+	if len(documents.items) != 1 {
+		t.Errorf("%d documents cached, want 1 (invalid one is not cached)", len(documents.items))
+	}
+}
+
+func TestDocumentCacheRequests(t *testing.T) {
+	schema := serviceSchema(t)
+	prev := documents
+	documents = newDocumentCache(10)
+	t.Cleanup(func() { documents = prev })
+	admin := &Principal{Role: RoleAdmin}
+	count := func() (float64, float64) {
+		return testutil.ToFloat64(documentCacheRequests.WithLabelValues("hit")), testutil.ToFloat64(documentCacheRequests.WithLabelValues("miss"))
+	}
+	hit, miss := count()
+	query := benchmarkQueries[0]
+	if _, err := parsedDocument(query); err != nil { // checks before execution are not counted
+		t.Fatal(err)
+	}
+	for _, want := range []struct{ hit, miss float64 }{{0, 1}, {1, 1}, {2, 1}} {
+		execute(schema, admin, query)
+		h, m := count()
+		if h-hit != want.hit || m-miss != want.miss {
+			t.Fatalf("hits %v, misses %v, want %v, %v", h-hit, m-miss, want.hit, want.miss)
+		}
+	}
+	execute(schema, admin, "{x_ride(id: 1) {id}") // parse error
+	if h, m := count(); h-hit != 2 || m-miss != 2 {
+		t.Errorf("hits %v, misses %v after invalid query, want 2, 2", h-hit, m-miss)
+	}
+}
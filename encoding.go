@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ----- response encodings -----
+
+// Content negotiation: json (compact, or indented if ?pretty is given), cbor and msgpack by Accept header;
+// gzip and deflate by Accept-Encoding for responses larger than config.Compression.
+// Streamed responses (sse, multipart) are not compressed. Tracing is added to json responses only.
+
+type responseEncoding struct {
+	contentType string
+	accepts     []string // media types of Accept header
+	marshal     func(v interface{}) ([]byte, error)
+	unmarshal   func(data []byte, v interface{}) error
+}
+
+var responseEncodings = []responseEncoding{
+	{
+		contentType: "application/cbor",
+		accepts:     []string{"application/cbor"},
+		marshal:     cbor.Marshal, // it takes json tags into account
+		unmarshal:   cbor.Unmarshal,
+	},
+	{
+		contentType: "application/msgpack",
+		accepts:     []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"},
+		marshal: func(v interface{}) ([]byte, error) {
+			var b bytes.Buffer
+			e := msgpack.NewEncoder(&b)
+			e.SetCustomStructTag("json") // graphql.Result has json tags only
+			err := e.Encode(v)
+			return b.Bytes(), err
+		},
+		unmarshal: func(data []byte, v interface{}) error {
+			d := msgpack.NewDecoder(bytes.NewReader(data))
+			d.SetCustomStructTag("json")
+			return d.Decode(v)
+		},
+	},
+}
+
+var jsonEncoding = responseEncoding{
+	contentType: "application/json; charset=utf-8",
+	marshal:     json.Marshal,
+	unmarshal:   json.Unmarshal,
+}
+
+func negotiateEncoding(r *http.Request) responseEncoding {
+	accept := r.Header.Get("Accept")
+	for _, e := range responseEncodings {
+		for _, a := range e.accepts {
+			if strings.Contains(accept, a) {
+				return e
+			}
+		}
+	}
+	if _, pretty := r.URL.Query()["pretty"]; pretty {
+		e := jsonEncoding
+		e.marshal = func(v interface{}) ([]byte, error) { return json.MarshalIndent(v, "", "\t") }
+		return e
+	}
+	return jsonEncoding
+}
+
+// writeResult writes result (or array of results) encoded according to request
+func writeResult(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	e := negotiateEncoding(r)
+	body, err := e.marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Add("Vary", "Accept")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// decodeResult decodes body written by writeResult
+func decodeResult(contentType string, body []byte, v interface{}) error {
+	for _, e := range responseEncodings {
+		if strings.HasPrefix(contentType, e.contentType) {
+			return e.unmarshal(body, v)
+		}
+	}
+	return json.Unmarshal(body, v)
+}
+
+// acceptedCompression returns gzip, deflate or nothing
+func acceptedCompression(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if len(fields) > 1 && strings.ReplaceAll(strings.TrimSpace(fields[1]), " ", "") == "q=0" {
+			continue
+		}
+		accepted[name] = true
+	}
+	for _, c := range []string{"gzip", "deflate"} {
+		if accepted[c] {
+			return c
+		}
+	}
+	return ""
+}
+
+// compressedETag: strong ETag differs for every representation
+func compressedETag(etag string, compression string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + compression + `"`
+}
+
+// withCompression calls next and compresses its response if it is worth it
+func withCompression(w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request)) {
+	b := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+	next(b, r)
+	body := b.body.Bytes()
+	w.Header().Add("Vary", "Accept-Encoding")
+	compression := acceptedCompression(r)
+	etag := w.Header().Get("ETag")
+	if b.status == http.StatusNotModified { // client has representation it has asked about
+		if compression != "" && etag != "" && strings.Contains(r.Header.Get("If-None-Match"), compressedETag(etag, compression)) {
+			w.Header().Set("ETag", compressedETag(etag, compression))
+		}
+		w.WriteHeader(b.status)
+		return
+	}
+	if compression == "" || len(body) < config.Compression || w.Header().Get("Content-Encoding") != "" {
+		w.WriteHeader(b.status)
+		w.Write(body)
+		return
+	}
+	var compressed bytes.Buffer
+	var cw io.WriteCloser
+	if compression == "gzip" {
+		cw = gzip.NewWriter(&compressed)
+	} else {
+		cw = zlib.NewWriter(&compressed) // http "deflate" is zlib format
+	}
+	cw.Write(body)
+	cw.Close()
+	if etag != "" {
+		w.Header().Set("ETag", compressedETag(etag, compression))
+	}
+	w.Header().Set("Content-Encoding", compression)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(b.status)
+	w.Write(compressed.Bytes())
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+)
+
+type testResult struct {
+	Data struct {
+		Items []string `json:"items"`
+	} `json:"data"`
+}
+
+// encodedResponse writes result of n items through writeResult and withCompression
+func encodedResponse(t *testing.T, n int, headers map[string]string, target string) *http.Response {
+	t.Helper()
+	items := make([]interface{}, n)
+	for i := range items {
+		items[i] = fmt.Sprintf("item %d", i)
+	}
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	withCompression(w, r, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"abc"`)
+		writeResult(w, r, http.StatusOK, &graphql.Result{Data: map[string]interface{}{"items": items}})
+	})
+	return w.Result()
+}
+
+// decodeResponse reverses compression and encoding
+func decodeResponse(t *testing.T, resp *http.Response) testResult {
+	t.Helper()
+	var body io.Reader = resp.Body
+	var err error
+	switch resp.Header.Get("Content-Encoding") {
+	case "gzip":
+		body, err = gzip.NewReader(body)
+	case "deflate":
+		body, err = zlib.NewReader(body)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result testResult
+	if err := decodeResult(resp.Header.Get("Content-Type"), data, &result); err != nil {
+		t.Fatalf("decode %s: %v", resp.Header.Get("Content-Type"), err)
+	}
+	return result
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	accepts := map[string]string{ // Accept: Content-Type
+		"":                        "application/json; charset=utf-8",
+		"application/json":        "application/json; charset=utf-8",
+		"application/cbor":        "application/cbor",
+		"application/msgpack":     "application/msgpack",
+		"application/x-msgpack":   "application/msgpack",
+		"application/vnd.msgpack": "application/msgpack",
+		"text/html, application/cbor;q=0.9, */*;q=0.8": "application/cbor",
+	}
+	compressions := map[string]string{ // Accept-Encoding: Content-Encoding
+		"":                   "",
+		"identity":           "",
+		"gzip":               "gzip",
+		"deflate":            "deflate",
+		"br, deflate, gzip":  "gzip",
+		"gzip;q=0, deflate":  "deflate",
+		"gzip; q=0, deflate": "deflate",
+	}
+	for accept, contentType := range accepts {
+		for acceptEncoding, contentEncoding := range compressions {
+			t.Run(fmt.Sprintf("%s/%s", contentType, acceptEncoding), func(t *testing.T) {
+				resp := encodedResponse(t, 200, map[string]string{"Accept": accept, "Accept-Encoding": acceptEncoding}, "/gql")
+				if got := resp.Header.Get("Content-Type"); got != contentType {
+					t.Errorf("Content-Type %q, want %q", got, contentType)
+				}
+				if got := resp.Header.Get("Content-Encoding"); got != contentEncoding {
+					t.Errorf("Content-Encoding %q, want %q", got, contentEncoding)
+				}
+				vary := strings.Join(resp.Header.Values("Vary"), ",")
+				if !strings.Contains(vary, "Accept") || !strings.Contains(vary, "Accept-Encoding") {
+					t.Errorf("Vary %q", vary)
+				}
+				wantETag := `"abc"`
+				if contentEncoding != "" {
+					wantETag = `"abc-` + contentEncoding + `"`
+				}
+				if got := resp.Header.Get("ETag"); got != wantETag {
+					t.Errorf("ETag %s, want %s", got, wantETag)
+				}
+				result := decodeResponse(t, resp)
+				if len(result.Data.Items) != 200 || result.Data.Items[199] != "item 199" {
+					t.Errorf("decoded %d items", len(result.Data.Items))
+				}
+			})
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	resp := encodedResponse(t, 3, map[string]string{"Accept-Encoding": "gzip"}, "/gql")
+	if got := resp.Header.Get("Content-Encoding"); got != "" {
+		t.Errorf("small response is compressed: %s", got)
+	}
+	if got := resp.Header.Get("ETag"); got != `"abc"` {
+		t.Errorf("ETag %s of identity representation", got)
+	}
+	if result := decodeResponse(t, resp); len(result.Data.Items) != 3 {
+		t.Errorf("decoded %d items", len(result.Data.Items))
+	}
+	if !strings.Contains(strings.Join(resp.Header.Values("Vary"), ","), "Accept-Encoding") {
+		t.Error("Vary has no Accept-Encoding, though representation depends on it")
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	resp := encodedResponse(t, 1, nil, "/gql?pretty")
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Contains(body, []byte("\n\t")) {
+		t.Errorf("json is not indented: %s", body)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// ----- errors -----
+
+// Resolvers return *Error, graphql layer puts its code and details into errors[].extensions.
+// Any other error is considered internal (or timeout if deadline exceeded).
+// In production mode messages of internal errors (sql, database path...) are logged and masked.
+
+type ErrorCode string
+
+const (
+	CodeNotFound            ErrorCode = "NOT_FOUND"
+	CodeValidation          ErrorCode = "VALIDATION"
+	CodeConflict            ErrorCode = "CONFLICT"
+	CodeUnauthenticated     ErrorCode = "UNAUTHENTICATED"
+	CodeForbidden           ErrorCode = "FORBIDDEN"
+	CodeInternal            ErrorCode = "INTERNAL"
+	CodeTimeout             ErrorCode = "TIMEOUT"
+	CodeInternalServerError ErrorCode = "INTERNAL_SERVER_ERROR" // panic
+
+	CodePersistedQueryNotFound ErrorCode = "PERSISTED_QUERY_NOT_FOUND" // apq protocol requires it
+
+	CodeGraphQLParseFailed      ErrorCode = "GRAPHQL_PARSE_FAILED" // request errors, codes are the same as apollo server uses
+	CodeGraphQLValidationFailed ErrorCode = "GRAPHQL_VALIDATION_FAILED"
+)
+
+const maskedMessage = "Internal server error"
+
+// production is set on startup, see ENV
+var production = false
+
+type Error struct {
+	Code    ErrorCode
+	Message string
+	Details map[string]interface{}
+}
+
+func newError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func NotFoundError(format string, args ...interface{}) *Error {
+	return newError(CodeNotFound, format, args...)
+}
+
+func ValidationError(format string, args ...interface{}) *Error {
+	return newError(CodeValidation, format, args...)
+}
+
+func ConflictError(format string, args ...interface{}) *Error {
+	return newError(CodeConflict, format, args...)
+}
+
+func UnauthenticatedError(format string, args ...interface{}) *Error {
+	return newError(CodeUnauthenticated, format, args...)
+}
+
+func ForbiddenError(format string, args ...interface{}) *Error {
+	return newError(CodeForbidden, format, args...)
+}
+
+func InternalError(format string, args ...interface{}) *Error {
+	return newError(CodeInternal, format, args...)
+}
+
+func TimeoutError(format string, args ...interface{}) *Error {
+	return newError(CodeTimeout, format, args...)
+}
+
+// WithDetail adds detail to be shown in extensions.details
+func (e *Error) WithDetail(key string, value interface{}) *Error {
+	if e.Details == nil {
+		e.Details = map[string]interface{}{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+func (e *Error) Error() string { return e.Message }
+
+// Extensions makes it gqlerrors.ExtendedError
+func (e *Error) Extensions() map[string]interface{} {
+	ext := map[string]interface{}{"code": string(e.Code)}
+	if len(e.Details) > 0 {
+		ext["details"] = e.Details
+	}
+	return ext
+}
+
+// formatError keeps extensions of *Error, gqlerrors.FormatError takes them from located errors only
+func formatError(err error) gqlerrors.FormattedError {
+	f := gqlerrors.FormatError(err)
+	if e, ok := err.(gqlerrors.ExtendedError); ok && f.Extensions == nil {
+		f.Extensions = e.Extensions()
+	}
+	return f
+}
+
+func isInternal(code string) bool {
+	return code == string(CodeInternal) || code == string(CodeInternalServerError)
+}
+
+// classifyErrors gives code to errors without code and masks internal ones in production
+func classifyErrors(ctx context.Context, errs []gqlerrors.FormattedError, defaultCode ErrorCode) {
+	for i := range errs {
+		e := &errs[i]
+		if e.Extensions == nil {
+			e.Extensions = map[string]interface{}{}
+		}
+		if _, ok := e.Extensions["code"].(string); !ok {
+			e.Extensions["code"] = string(defaultCode)
+			if errors.Is(e.OriginalError(), context.DeadlineExceeded) {
+				e.Extensions["code"] = string(CodeTimeout)
+			}
+		}
+		if production && isInternal(e.Extensions["code"].(string)) && e.Message != maskedMessage {
+			slog.ErrorContext(ctx, "internal error", slog.String("error", e.Message), slog.Any("path", e.Path))
+			e.Message = maskedMessage
+			delete(e.Extensions, "details")
+		}
+	}
+}
+
+// errorsExtension has to be the first extension of schema, others see classified errors
+type errorsExtension struct{}
+
+func (errorsExtension) Init(ctx context.Context, p *graphql.Params) context.Context { return ctx }
+
+func (errorsExtension) Name() string { return "errors" }
+
+func (errorsExtension) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+	return ctx, func(error) {}
+}
+
+func (errorsExtension) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+	return ctx, func(errs []gqlerrors.FormattedError) {
+		classifyErrors(ctx, errs, CodeGraphQLValidationFailed) // errs share array with result
+	}
+}
+
+func (errorsExtension) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+	return ctx, func(r *graphql.Result) {
+		classifyErrors(ctx, r.Errors, CodeInternal)
+	}
+}
+
+func (errorsExtension) ResolveFieldDidStart(ctx context.Context, i *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+	return ctx, func(interface{}, error) {}
+}
+
+func (errorsExtension) HasResult() bool { return false }
+
+func (errorsExtension) GetResult(context.Context) interface{} { return nil }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+)
+
+func TestRequestErrorsExtensions(t *testing.T) {
+	schema := serviceSchema(t)
+	for _, c := range []struct {
+		query string
+		code  ErrorCode
+	}{
+		{"{ x_ride(id: 1) {", CodeGraphQLParseFailed},
+		{"{ x_ride(id: 1) { unknown } }", CodeGraphQLValidationFailed},
+	} {
+		t.Run(string(c.code), func(t *testing.T) {
+			ctx := withRequestId(context.Background(), "req-1")
+			result := executeQuery(graphql.Params{Schema: *schema, RequestString: c.query, Context: ctx})
+			if len(result.Errors) == 0 {
+				t.Fatal("no errors")
+			}
+			for _, e := range result.Errors {
+				if e.Extensions["code"] != string(c.code) || e.Extensions["request_id"] != "req-1" {
+					t.Errorf("extensions %v", e.Extensions)
+				}
+			}
+		})
+	}
+}
+
+func TestFormatErrorKeepsExtensions(t *testing.T) {
+	f := formatError(ForbiddenError("no"))
+	if f.Extensions["code"] != string(CodeForbidden) {
+		t.Errorf("extensions %v", f.Extensions)
+	}
+}
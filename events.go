@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// ----- events -----
+
+// In-process event bus: mutations publish, subscriptions listen.
+// Publishing never blocks: if subscriber is too slow, event is dropped for it.
+// Every event gets sequence number; last events are kept to be replayed for reconnected clients.
+
+const (
+	TopicRideAdded         = "ride_added"
+	TopicRideStatusChanged = "ride_status_changed"
+)
+
+const subscriberBufferSize = 16
+
+type Event struct {
+	Seq   uint64 // set by Publish
+	Topic string
+	Ride  *CompleteRide
+}
+
+type subscriber struct {
+	topic  string
+	filter func(Event) bool
+	ch     chan Event
+}
+
+func (s *subscriber) match(e Event) bool {
+	return s.topic == e.Topic && (s.filter == nil || s.filter(e))
+}
+
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	seq         uint64
+	history     []Event // the latest config.Subscriptions.HistorySize events, oldest first
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: map[*subscriber]struct{}{}}
+}
+
+// Subscribe returns channel of events and function to unsubscribe; channel is closed on unsubscribe
+func (b *EventBus) Subscribe(topic string, filter func(Event) bool) (<-chan Event, func()) {
+	return b.subscribe(topic, filter, nil)
+}
+
+// SubscribeAfter is like Subscribe, but first of all, it passes kept events with sequence number greater than after.
+// Events, that are already gone from history, are lost.
+func (b *EventBus) SubscribeAfter(topic string, filter func(Event) bool, after uint64) (<-chan Event, func()) {
+	return b.subscribe(topic, filter, &after)
+}
+
+func (b *EventBus) subscribe(topic string, filter func(Event) bool, after *uint64) (<-chan Event, func()) {
+	s := &subscriber{
+		topic:  topic,
+		filter: filter,
+	}
+	b.mu.Lock()
+	var backlog []Event
+	if after != nil {
+		for _, e := range b.history {
+			if e.Seq > *after && s.match(e) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+	s.ch = make(chan Event, len(backlog)+subscriberBufferSize)
+	for _, e := range backlog {
+		s.ch <- e
+	}
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	return s.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subscribers, s)
+			close(s.ch)
+			b.mu.Unlock()
+		})
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	if n := config.Subscriptions.HistorySize; len(b.history) >= n { // size can be reduced by tests
+		b.history = append(b.history[:0], b.history[len(b.history)-n+1:]...)
+	}
+	b.history = append(b.history, e)
+	for s := range b.subscribers {
+		if !s.match(e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			slog.Warn("event dropped for slow subscriber", slog.String("topic", e.Topic), slog.Uint64("seq", e.Seq))
+		}
+	}
+}
+
+var rideEvents = NewEventBus()
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// ----- health -----
+
+// Probes for orchestrator:
+// /healthz: process is alive;
+// /readyz: database answers, migrations are applied, schema is built and server is not shutting down
+// (on signal readiness fails for timeouts.drain before server stops accepting connections);
+// /version: module version and vcs revision of build, schema hash.
+
+func setupHealth() {
+	http.HandleFunc("/healthz", serveHealth)
+	http.HandleFunc("/readyz", serveReadiness)
+	http.HandleFunc("/version", serveVersion)
+}
+
+func writeProbe(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	writeProbe(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readinessChecks return nil if component is ready
+var readinessChecks = []struct {
+	name  string
+	check func(ctx context.Context) error
+}{
+	{"shutdown", func(context.Context) error {
+		if shuttingDown.Load() {
+			return fmt.Errorf("server is shutting down")
+		}
+		return nil
+	}},
+	{"schema", func(context.Context) error {
+		if schemaVersion == "" {
+			return fmt.Errorf("schema is not built")
+		}
+		return nil
+	}},
+	{"database", func(ctx context.Context) error {
+		sql(ctx, "select 1")
+		return nil
+	}},
+	{"migrations", func(context.Context) error {
+		if v := dbVersion(); v != SchemaVersion() {
+			return fmt.Errorf("database version is %d, %d is expected", v, SchemaVersion())
+		}
+		return nil
+	}},
+}
+
+func serveReadiness(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	checks := map[string]string{}
+	for _, c := range readinessChecks {
+		if err := safeCheck(r.Context(), c.check); err != nil {
+			checks[c.name] = err.Error()
+			status = http.StatusServiceUnavailable
+		} else {
+			checks[c.name] = "ok"
+		}
+	}
+	result := map[string]interface{}{"status": "ok", "checks": checks}
+	if status != http.StatusOK {
+		result["status"] = "unavailable"
+	}
+	writeProbe(w, status, result)
+}
+
+// safeCheck turns panic (sql panics) into error
+func safeCheck(ctx context.Context, check func(ctx context.Context) error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	return check(ctx)
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	version := map[string]string{"schema": schemaVersion}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		version["module"] = info.Main.Path
+		version["version"] = info.Main.Version
+		version["go"] = info.GoVersion
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				version["revision"] = s.Value
+			case "vcs.time":
+				version["revisionTime"] = s.Value
+			case "vcs.modified":
+				version["modified"] = s.Value
+			}
+		}
+	}
+	writeProbe(w, http.StatusOK, version)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// ----- http caching -----
+
+// Queries can be sent by GET: /gql?query=...&variables=...&operationName=... (mutations can not).
+// Response of GET query gets Cache-Control according to cache hints of fields (like Apollo @cacheControl):
+// max-age is the least max-age of hinted fields; fields without hints inherit it from parent;
+// root fields without hints get default_max_age. One private field makes response private.
+// Hints are config.HTTPCache.Hints: Type.field:max_age or Type.field:max_age:private.
+// Every GET response gets strong ETag, If-None-Match is respected.
+
+type CacheHint struct {
+	MaxAge  int // seconds
+	Private bool
+}
+
+// HTTPCacheConfig is config.HTTPCache
+type HTTPCacheConfig struct {
+	DefaultMaxAge time.Duration `config:"default_max_age" env:"CACHE_DEFAULT_MAX_AGE" help:"max age of root fields without hints"`
+	Hints         []string      `config:"hints" env:"CACHE_HINTS" help:"cache hints of fields: Type.field:max_age or Type.field:max_age:private"`
+}
+
+func defaultHTTPCacheConfig() HTTPCacheConfig {
+	return HTTPCacheConfig{Hints: []string{
+		"Query.x_ride:1m",
+		"Query.x_rides:30s",
+		"Query.x_customer:5m",
+		"Query.search:1m",
+		"Query.searchRides:1m",
+		"Query.stats:1m",
+		"Driver.name:1h",
+		"Customer.name:1h",
+		"Driver.rides:30s",
+		"Driver.ridesCount:30s",
+		"Customer.rides:30s",
+		"Customer.deep_rides:30s",
+		"Customer.ridesCount:30s",
+		"Ride.status:10s",
+		"Vehicle.retired:5m",
+	}}
+}
+
+// cacheHints and defaultCacheHint are set by setupHTTPCache
+var (
+	cacheHints       = map[string]CacheHint{}
+	defaultCacheHint = CacheHint{MaxAge: 0}
+)
+
+// noCacheHint is for responses that are not cacheable by their nature
+var noCacheHint = CacheHint{MaxAge: 0}
+
+func setupHTTPCache(c HTTPCacheConfig) error {
+	hints, err := parseCacheHints(c.Hints)
+	if err != nil {
+		return err
+	}
+	cacheHints = hints
+	defaultCacheHint = CacheHint{MaxAge: int(c.DefaultMaxAge.Seconds())}
+	return nil
+}
+
+// parseCacheHints is used by config validation too
+func parseCacheHints(hints []string) (map[string]CacheHint, error) {
+	result := map[string]CacheHint{}
+	for _, s := range hints {
+		parts := strings.Split(s, ":")
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "private") {
+			return nil, fmt.Errorf("Invalid cache hint %q, Type.field:max_age or Type.field:max_age:private is expected", s)
+		}
+		if t, f, ok := strings.Cut(parts[0], "."); !ok || t == "" || f == "" {
+			return nil, fmt.Errorf("Invalid cache hint %q, field has to be Type.field", s)
+		}
+		maxAge, err := time.ParseDuration(parts[1])
+		if err != nil || maxAge < 0 {
+			return nil, fmt.Errorf("Invalid max age of cache hint %q", s)
+		}
+		result[parts[0]] = CacheHint{MaxAge: int(maxAge.Seconds()), Private: len(parts) == 3}
+	}
+	return result, nil
+}
+
+func (h CacheHint) header() string {
+	if h.MaxAge <= 0 {
+		return "no-cache" // it still can be revalidated by ETag
+	}
+	if h.Private {
+		return fmt.Sprintf("private, max-age=%d", h.MaxAge)
+	}
+	return fmt.Sprintf("public, max-age=%d", h.MaxAge)
+}
+
+// cachePolicy combines hints of all fields of operation
+func cachePolicy(schema *graphql.Schema, query string, operationName string) CacheHint {
+	doc, err := parsedDocument(query)
+	if err != nil {
+		return noCacheHint
+	}
+	fragments := map[string]*ast.FragmentDefinition{}
+	var operation *ast.OperationDefinition
+	for _, d := range doc.Definitions {
+		switch n := d.(type) {
+		case *ast.OperationDefinition:
+			if operationName == "" || (n.Name != nil && n.Name.Value == operationName) {
+				operation = n
+			}
+		case *ast.FragmentDefinition:
+			fragments[n.Name.Value] = n
+		}
+	}
+	if operation == nil || operation.Operation != ast.OperationTypeQuery {
+		return noCacheHint
+	}
+	policy := CacheHint{MaxAge: -1} // not restricted yet
+	restrict := func(h CacheHint) {
+		if policy.MaxAge < 0 || h.MaxAge < policy.MaxAge {
+			policy.MaxAge = h.MaxAge
+		}
+		policy.Private = policy.Private || h.Private
+	}
+	visiting := map[string]bool{}
+	var walk func(set *ast.SelectionSet, parent graphql.Type, root bool)
+	walk = func(set *ast.SelectionSet, parent graphql.Type, root bool) {
+		if set == nil {
+			return
+		}
+		for _, s := range set.Selections {
+			switch s := s.(type) {
+			case *ast.Field:
+				name := s.Name.Value
+				if strings.HasPrefix(name, "__") {
+					continue
+				}
+				def, ok := fieldsOf(parent)[name]
+				if !ok {
+					continue
+				}
+				if h, ok := cacheHints[parent.Name()+"."+name]; ok {
+					restrict(h)
+				} else if root {
+					restrict(defaultCacheHint)
+				}
+				walk(s.SelectionSet, namedType(def.Type), false)
+			case *ast.InlineFragment:
+				t := parent
+				if s.TypeCondition != nil {
+					t = schema.Type(s.TypeCondition.Name.Value)
+				}
+				walk(s.SelectionSet, t, root)
+			case *ast.FragmentSpread:
+				f, ok := fragments[s.Name.Value]
+				if !ok || visiting[s.Name.Value] {
+					continue
+				}
+				visiting[s.Name.Value] = true
+				walk(f.SelectionSet, schema.Type(f.TypeCondition.Name.Value), root)
+				delete(visiting, s.Name.Value)
+			}
+		}
+	}
+	walk(operation.SelectionSet, schema.QueryType(), true)
+	if policy.MaxAge < 0 {
+		return defaultCacheHint
+	}
+	return policy
+}
+
+func strongETag(body []byte) string {
+	h := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(h[:16]) + `"`
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		for _, c := range []string{"gzip", "deflate"} { // see compressedETag
+			t = strings.Replace(t, "-"+c+`"`, `"`, 1)
+		}
+		if t == etag || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// withSafeGET rejects GET request with operation other than query, it has to be checked before any way of execution;
+// the only exception is subscription over event stream: EventSource of browsers can send GET only
+func withSafeGET(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return true
+	}
+	opts := peekRequestOptions(r)
+	t, _ := operationType(opts.Query, opts.OperationName) // invalid document is reported by execution
+	if t == ast.OperationTypeMutation || t == ast.OperationTypeSubscription && !isEventStreamRequest(r) {
+		w.Header().Set("Allow", http.MethodPost)
+		writeResult(w, r, http.StatusMethodNotAllowed, rejectedResult(r.Context(), ValidationError("Only queries can be sent by GET")))
+		return false
+	}
+	return true
+}
+
+// withCacheHeaders serves GET request: sets Cache-Control and ETag, replies 304 if possible
+func withCacheHeaders(schema *graphql.Schema, w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request)) {
+	opts := peekRequestOptions(r)
+	b := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+	next(b, r)
+	body := b.body.Bytes()
+	var result struct {
+		Errors []interface{} `json:"errors"`
+	}
+	if b.status == http.StatusOK && decodeResult(w.Header().Get("Content-Type"), body, &result) == nil && len(result.Errors) == 0 {
+		policy := cachePolicy(schema, opts.Query, opts.OperationName)
+		policy.Private = policy.Private || principalFromContext(r.Context()) != nil // response depends on user
+		w.Header().Set("Cache-Control", policy.header())
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	etag := strongETag(body)
+	w.Header().Set("ETag", etag)
+	w.Header().Del("Content-Length")
+	if b.status == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(b.status)
+	w.Write(body)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+)
+
+func TestParseCacheHints(t *testing.T) {
+	hints, err := parseCacheHints([]string{"Query.x_ride:1m", "Customer.email:5m:private", "Ride.status:0s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]CacheHint{
+		"Query.x_ride":   {MaxAge: 60},
+		"Customer.email": {MaxAge: 300, Private: true},
+		"Ride.status":    {MaxAge: 0},
+	} {
+		if got := hints[field]; got != want {
+			t.Errorf("%s: %+v, want %+v", field, got, want)
+		}
+	}
+	for _, invalid := range []string{"Query.x_ride", "x_ride:1m", "Query.:1m", "Query.x_ride:1m:public", "Query.x_ride:soon", "Query.x_ride:-1m"} {
+		if _, err := parseCacheHints([]string{invalid}); err == nil {
+			t.Errorf("invalid hint %q is accepted", invalid)
+		}
+	}
+	if _, err := parseCacheHints(defaultHTTPCacheConfig().Hints); err != nil {
+		t.Errorf("default hints: %v", err)
+	}
+}
+
+func TestCacheHintsFromEnvironment(t *testing.T) {
+	t.Setenv("CACHE_HINTS", "Query.x_ride:2m, Ride.status:5s")
+	t.Setenv("CACHE_DEFAULT_MAX_AGE", "10s")
+	c, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.HTTPCache.Hints) != 2 || c.HTTPCache.DefaultMaxAge.Seconds() != 10 {
+		t.Errorf("http cache config %+v", c.HTTPCache)
+	}
+	t.Setenv("CACHE_HINTS", "Query.x_ride")
+	if _, err := loadConfig(nil); err == nil {
+		t.Error("invalid hint is accepted")
+	}
+}
+
+func TestETag(t *testing.T) {
+	prevHints, prevDefault := cacheHints, defaultCacheHint
+	t.Cleanup(func() { cacheHints, defaultCacheHint = prevHints, prevDefault })
+	if err := setupHTTPCache(HTTPCacheConfig{Hints: []string{"Query.hello:1m"}}); err != nil {
+		t.Fatal(err)
+	}
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name:   "Query",
+		Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String}},
+	})
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(ifNoneMatch string, acceptEncoding string) *http.Response {
+		r := httptest.NewRequest(http.MethodGet, "/gql?query="+url.QueryEscape("{hello}"), nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		withCompression(w, r, func(w http.ResponseWriter, r *http.Request) {
+			withCacheHeaders(&schema, w, r, func(w http.ResponseWriter, r *http.Request) {
+				writeResult(w, r, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"hello": "world"}})
+			})
+		})
+		return w.Result()
+	}
+
+	first := serve("", "")
+	etag := first.Header.Get("ETag")
+	if first.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("status %d, ETag %q", first.StatusCode, etag)
+	}
+	if got := first.Header.Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("Cache-Control %q", got)
+	}
+	for _, c := range []struct {
+		name        string
+		ifNoneMatch string
+		status      int
+	}{
+		{"same", etag, http.StatusNotModified},
+		{"one of", `"other", ` + etag, http.StatusNotModified},
+		{"any", "*", http.StatusNotModified},
+		{"compressed representation", compressedETag(etag, "gzip"), http.StatusNotModified},
+		{"changed", `"other"`, http.StatusOK},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			resp := serve(c.ifNoneMatch, "")
+			if resp.StatusCode != c.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, c.status)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if c.status == http.StatusNotModified && len(body) > 0 {
+				t.Errorf("304 with body %s", body)
+			}
+			if resp.Header.Get("ETag") != etag {
+				t.Errorf("ETag %s, want %s", resp.Header.Get("ETag"), etag)
+			}
+		})
+	}
+	if resp := serve(compressedETag(etag, "gzip"), "gzip"); resp.StatusCode != http.StatusNotModified ||
+		resp.Header.Get("ETag") != compressedETag(etag, "gzip") {
+		t.Errorf("compressed: status %d, ETag %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
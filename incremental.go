@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// ----- incremental delivery: @defer and @stream -----
+
+// graphql-go knows nothing about incremental delivery, so we do it by ourselves:
+// - deferred fragments are cut off from the query, the rest is executed as usual;
+// - every deferred fragment and streamed field becomes separate query: path from root to it and it itself;
+// - all queries are executed concurrently with shared loaders, so repeated parts of paths are almost free;
+// - streamed field stays in its parent, but list is cut to initialCount items there (see sliceStreamed);
+//   the rest items are resolved one by one by query of streamed field, every item is sent as soon as it is ready;
+// - results are sent as multipart/mixed parts as soon as they are ready (and parent part is sent).
+// Only queries are processed this way, mutations are never executed twice.
+
+var deferDirective = graphql.NewDirective(graphql.DirectiveConfig{
+	Name:      "defer",
+	Locations: []string{graphql.DirectiveLocationFragmentSpread, graphql.DirectiveLocationInlineFragment},
+	Args: graphql.FieldConfigArgument{
+		"if":    &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: true},
+		"label": &graphql.ArgumentConfig{Type: graphql.String},
+	},
+})
+
+var streamDirective = graphql.NewDirective(graphql.DirectiveConfig{
+	Name:      "stream",
+	Locations: []string{graphql.DirectiveLocationField},
+	Args: graphql.FieldConfigArgument{
+		"if":           &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: true},
+		"label":        &graphql.ArgumentConfig{Type: graphql.String},
+		"initialCount": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+	},
+})
+
+func acceptsMultipart(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "multipart/mixed")
+}
+
+// Plan
+
+type branch struct {
+	stream       bool
+	label        string
+	path         []string // response keys from root to parent object of fragment or streamed field
+	fieldKey     string   // stream only: response key of streamed field
+	initialCount int      // stream only
+	parent       *branch  // nil means initial response
+	doc          *ast.Document
+	sent         chan struct{} // all parts of branch are sent, so client knows about its paths
+}
+
+// key identifies streamed field, see fieldPathKey
+func (b *branch) key() string {
+	return strings.Join(append(append([]string{}, b.path...), b.fieldKey), ".")
+}
+
+// within reports that b is a or is nested into a
+func (b *branch) within(a *branch) bool {
+	for ; b != nil; b = b.parent {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+type planner struct {
+	operation *ast.OperationDefinition
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]interface{}
+	branches  []*branch
+}
+
+func directiveByName(directives []*ast.Directive, name string) *ast.Directive {
+	for _, d := range directives {
+		if d.Name != nil && d.Name.Value == name {
+			return d
+		}
+	}
+	return nil
+}
+
+func withoutDirective(directives []*ast.Directive, name string) []*ast.Directive {
+	r := []*ast.Directive{}
+	for _, d := range directives {
+		if d.Name == nil || d.Name.Value != name {
+			r = append(r, d)
+		}
+	}
+	return r
+}
+
+func (pl *planner) argument(d *ast.Directive, name string) interface{} {
+	for _, a := range d.Arguments {
+		if a.Name == nil || a.Name.Value != name {
+			continue
+		}
+		switch v := a.Value.(type) {
+		case *ast.Variable:
+			return pl.variables[v.Name.Value]
+		case *ast.BooleanValue:
+			return v.Value
+		case *ast.StringValue:
+			return v.Value
+		case *ast.IntValue:
+			i, err := strconv.Atoi(v.Value)
+			if err == nil {
+				return i
+			}
+		}
+	}
+	return nil
+}
+
+// active returns directive if it is present and is not turned off by if argument
+func (pl *planner) active(directives []*ast.Directive, name string) *ast.Directive {
+	d := directiveByName(directives, name)
+	if d == nil {
+		return nil
+	}
+	if on, ok := pl.argument(d, "if").(bool); ok && !on {
+		return nil
+	}
+	return d
+}
+
+func (pl *planner) newBranch(d *ast.Directive, chain []ast.Selection, parent *branch) *branch {
+	b := &branch{
+		path:   responsePath(chain),
+		parent: parent,
+		sent:   make(chan struct{}),
+	}
+	b.label, _ = pl.argument(d, "label").(string)
+	pl.branches = append(pl.branches, b)
+	return b
+}
+
+func responseKey(f *ast.Field) string {
+	if f.Alias != nil {
+		return f.Alias.Value
+	}
+	return f.Name.Value
+}
+
+func responsePath(chain []ast.Selection) []string {
+	path := []string{}
+	for _, s := range chain {
+		if f, ok := s.(*ast.Field); ok {
+			path = append(path, responseKey(f))
+		}
+	}
+	return path
+}
+
+func extend(chain []ast.Selection, s ast.Selection) []ast.Selection {
+	r := make([]ast.Selection, len(chain), len(chain)+1)
+	copy(r, chain)
+	return append(r, s)
+}
+
+// cut returns copy of selection set without deferred fragments, they are registered as branches,
+// streamed fields are registered too; named fragments are inlined on the fly
+func (pl *planner) cut(ss *ast.SelectionSet, chain []ast.Selection, parent *branch) *ast.SelectionSet {
+	if ss == nil {
+		return nil
+	}
+	out := *ss
+	out.Selections = []ast.Selection{}
+	for _, s := range ss.Selections {
+		if spread, ok := s.(*ast.FragmentSpread); ok {
+			def := pl.fragments[spread.Name.Value] // document is valid, fragment exists
+			s = ast.NewInlineFragment(&ast.InlineFragment{
+				Loc:           spread.Loc,
+				TypeCondition: def.TypeCondition,
+				Directives:    spread.Directives,
+				SelectionSet:  def.SelectionSet,
+			})
+		}
+		switch n := s.(type) {
+		case *ast.Field:
+			c := *n
+			if d := pl.active(n.Directives, "stream"); d != nil {
+				c.Directives = withoutDirective(n.Directives, "stream")
+				b := pl.newBranch(d, chain, parent)
+				b.stream = true
+				b.fieldKey = responseKey(n)
+				b.initialCount, _ = pl.argument(d, "initialCount").(int)
+				c.SelectionSet = pl.cut(n.SelectionSet, extend(chain, &c), b)
+				b.doc = pl.document(chain, &c)
+				out.Selections = append(out.Selections, &c) // initial items
+				continue
+			}
+			c.SelectionSet = pl.cut(n.SelectionSet, extend(chain, &c), parent)
+			out.Selections = append(out.Selections, &c)
+		case *ast.InlineFragment:
+			c := *n
+			if d := pl.active(n.Directives, "defer"); d != nil {
+				c.Directives = withoutDirective(n.Directives, "defer")
+				b := pl.newBranch(d, chain, parent)
+				c.SelectionSet = pl.cut(n.SelectionSet, extend(chain, &c), b)
+				b.doc = pl.document(chain, &c)
+				continue
+			}
+			c.SelectionSet = pl.cut(n.SelectionSet, extend(chain, &c), parent)
+			out.Selections = append(out.Selections, &c)
+		}
+	}
+	return &out
+}
+
+// document builds query with the only path: chain down to leaf
+func (pl *planner) document(chain []ast.Selection, leaf ast.Selection) *ast.Document {
+	s := leaf
+	for i := len(chain) - 1; i >= 0; i-- {
+		ss := ast.NewSelectionSet(&ast.SelectionSet{Selections: []ast.Selection{s}})
+		switch n := chain[i].(type) {
+		case *ast.Field:
+			c := *n
+			c.SelectionSet = ss
+			s = &c
+		case *ast.InlineFragment:
+			c := *n
+			c.SelectionSet = ss
+			s = &c
+		}
+	}
+	return pl.documentWith(ast.NewSelectionSet(&ast.SelectionSet{Selections: []ast.Selection{s}}))
+}
+
+func (pl *planner) documentWith(ss *ast.SelectionSet) *ast.Document {
+	op := *pl.operation
+	op.SelectionSet = ss
+	return ast.NewDocument(&ast.Document{Definitions: []ast.Node{&op}})
+}
+
+// Result trees
+
+type located struct {
+	path  []interface{}
+	value map[string]interface{}
+}
+
+// objectsAt finds all objects (going through lists) at path
+func objectsAt(data interface{}, path []string) []located {
+	var r []located
+	var walk func(v interface{}, i int, p []interface{})
+	walk = func(v interface{}, i int, p []interface{}) {
+		switch x := v.(type) {
+		case []interface{}:
+			for j, e := range x {
+				walk(e, i, append(append([]interface{}{}, p...), j))
+			}
+		case map[string]interface{}:
+			if i == len(path) {
+				r = append(r, located{path: p, value: x})
+				return
+			}
+			walk(x[path[i]], i+1, append(append([]interface{}{}, p...), path[i]))
+		}
+	}
+	walk(data, 0, []interface{}{})
+	return r
+}
+
+// Streamed lists
+
+type streamSlicesKey struct{}
+
+// itemRange is range of list items to be resolved by execution
+type itemRange struct {
+	from, to int
+}
+
+// fieldPathKey is response path of field without list indexes: "x_customer.rides"
+func fieldPathKey(path *graphql.ResponsePath) string {
+	keys := []string{}
+	for _, k := range path.AsArray() {
+		if s, ok := k.(string); ok {
+			keys = append(keys, s)
+		}
+	}
+	return strings.Join(keys, ".")
+}
+
+// sliceStreamed wraps resolver of list field: if execution asks for range of this field
+// (streamSlicesKey, by fieldPathKey), only items of range are resolved
+func sliceStreamed(resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		slices, _ := p.Context.Value(streamSlicesKey{}).(map[string]itemRange)
+		rng, ok := slices[fieldPathKey(p.Info.Path)]
+		if !ok {
+			return resolve(p)
+		}
+		result, err := resolve(p)
+		if err != nil {
+			return result, err
+		}
+		if thunk, ok := result.(func() (interface{}, error)); ok {
+			return func() (interface{}, error) {
+				r, err := thunk()
+				if err != nil {
+					return r, err
+				}
+				return sliceList(r, rng), nil
+			}, nil
+		}
+		return sliceList(result, rng), nil
+	}
+}
+
+func sliceList(list interface{}, rng itemRange) interface{} {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice {
+		return list // nil or not a list at all
+	}
+	from, to := min(rng.from, v.Len()), min(rng.to, v.Len())
+	return v.Slice(from, to).Interface()
+}
+
+// streamResolvers lets list fields to be streamed, see sliceStreamed
+func streamResolvers(schema *graphql.Schema) {
+	for name, t := range schema.TypeMap() {
+		object, ok := t.(*graphql.Object)
+		if !ok || strings.HasPrefix(name, "__") {
+			continue
+		}
+		for _, f := range object.Fields() {
+			if _, ok := graphql.GetNullable(f.Type).(*graphql.List); !ok {
+				continue
+			}
+			resolve := f.Resolve
+			if resolve == nil {
+				resolve = graphql.DefaultResolveFn
+			}
+			f.Resolve = sliceStreamed(resolve)
+		}
+	}
+}
+
+// Execution
+
+type multipartWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	flusher http.Flusher
+	pending int // initial part and branches that are not finished
+}
+
+// part sends payload; last means that it is the last part of initial response or of branch
+func (m *multipartWriter) part(payload map[string]interface{}, last bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last {
+		m.pending--
+	}
+	payload["hasNext"] = m.pending > 0
+	body, err := json.Marshal(payload)
+	if err != nil {
+		body, _ = json.Marshal(map[string]interface{}{
+			"errors":  []gqlerrors.FormattedError{gqlerrors.FormatError(err)},
+			"hasNext": m.pending > 0,
+		})
+	}
+	fmt.Fprintf(m.w, "\r\n---\r\nContent-Type: application/json; charset=utf-8\r\n\r\n%s", body)
+	if m.pending == 0 {
+		io.WriteString(m.w, "\r\n-----\r\n")
+	}
+	m.flusher.Flush()
+}
+
+// serveIncremental returns false if request is not for incremental delivery, request is kept untouched in this case
+func serveIncremental(schema *graphql.Schema, w http.ResponseWriter, r *http.Request) bool {
+	flusher, ok := w.(http.Flusher)
+	if !ok || r.Method == http.MethodOptions || !acceptsMultipart(r) {
+		return false
+	}
+	opts := peekRequestOptions(r) // body is kept for original handler if we give up
+	doc, ok := validDocument(schema, opts.Query)
+	if !ok {
+		return false // let original handler report errors
+	}
+	pl := &planner{
+		fragments: map[string]*ast.FragmentDefinition{},
+		variables: opts.Variables,
+	}
+	for _, d := range doc.Definitions {
+		switch n := d.(type) {
+		case *ast.OperationDefinition:
+			if opts.OperationName == "" || (n.Name != nil && n.Name.Value == opts.OperationName) {
+				pl.operation = n
+			}
+		case *ast.FragmentDefinition:
+			pl.fragments[n.Name.Value] = n
+		}
+	}
+	if pl.operation == nil || pl.operation.Operation != ast.OperationTypeQuery {
+		return false
+	}
+	setOperationLabels(r.Context(), operationNameLabel(opts.Query, opts.OperationName), ast.OperationTypeQuery)
+	initial := pl.documentWith(pl.cut(pl.operation.SelectionSet, nil, nil))
+	if len(pl.branches) == 0 {
+		return false
+	}
+
+	ctx := withLogAttrs(r.Context(), slog.String("operation", opts.OperationName)) // there is no loggingExtension.Init for Execute
+	ctx = context.WithValue(ctx, "dataloaders", NewLoaders())
+	// slices returns ranges of streamed lists for execution of branch (nil is initial response):
+	// lists get their initial items, but lists the branch is nested into are resolved completely
+	slices := func(b *branch, own *itemRange) map[string]itemRange {
+		r := map[string]itemRange{}
+		for _, s := range pl.branches {
+			if s.stream && !b.within(s) {
+				r[s.key()] = itemRange{0, s.initialCount}
+			}
+		}
+		if own != nil {
+			r[b.key()] = *own
+		}
+		return r
+	}
+	execute := func(doc *ast.Document, slices map[string]itemRange) (result *graphql.Result) {
+		defer recoverGoroutine(ctx, "panic in deferred execution", func() { result = internalErrorResult(ctx) })
+		return graphql.Execute(graphql.ExecuteParams{
+			Schema:        *schema,
+			AST:           doc,
+			OperationName: opts.OperationName,
+			Args:          opts.Variables,
+			Context:       context.WithValue(ctx, streamSlicesKey{}, slices),
+		})
+	}
+
+	w.Header().Set("Content-Type", `multipart/mixed; boundary="-"; deferSpec=20220824`)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	m := &multipartWriter{w: w, flusher: flusher, pending: len(pl.branches) + 1}
+	initialSent := make(chan struct{})
+	parentSent := func(b *branch) chan struct{} {
+		if b.parent == nil {
+			return initialSent
+		}
+		return b.parent.sent
+	}
+
+	var wg sync.WaitGroup
+	for _, b := range pl.branches {
+		wg.Add(1)
+		go func(b *branch) {
+			defer wg.Done()
+			defer recoverGoroutine(ctx, "panic in incremental delivery", nil)
+			defer close(b.sent)
+			waited := false
+			send := func(payload map[string]interface{}, last bool) {
+				if !waited {
+					<-parentSent(b)
+					waited = true
+				}
+				m.part(payload, last)
+			}
+			if !b.stream {
+				entries, _ := incrementalEntries(b, execute(b.doc, slices(b, nil)), 0)
+				send(map[string]interface{}{"incremental": entries}, true)
+				return
+			}
+			for i := b.initialCount; ; i++ { // items are resolved and sent one by one
+				entries, items := incrementalEntries(b, execute(b.doc, slices(b, &itemRange{i, i + 1})), i)
+				if items == 0 { // end of lists, entries can carry errors only
+					payload := map[string]interface{}{}
+					if len(entries) > 0 {
+						payload["incremental"] = entries
+					}
+					send(payload, true)
+					return
+				}
+				send(map[string]interface{}{"incremental": entries}, false)
+			}
+		}(b)
+	}
+
+	result := execute(initial, slices(nil, nil))
+	payload := map[string]interface{}{"data": result.Data}
+	if result.HasErrors() {
+		payload["errors"] = result.Errors
+	}
+	m.part(payload, true)
+	close(initialSent)
+	wg.Wait()
+	return true
+}
+
+// incrementalEntries makes entries of branch result; items is number of streamed items, index is index of the first one
+func incrementalEntries(b *branch, result *graphql.Result, index int) (entries []map[string]interface{}, items int) {
+	entries = []map[string]interface{}{}
+	for _, o := range objectsAt(result.Data, b.path) {
+		entry := map[string]interface{}{}
+		if b.stream {
+			list, ok := o.value[b.fieldKey].([]interface{})
+			if !ok || len(list) == 0 {
+				continue
+			}
+			items += len(list)
+			entry["items"] = list
+			entry["path"] = append(append([]interface{}{}, o.path...), b.fieldKey, index)
+		} else {
+			entry["data"] = o.value
+			entry["path"] = o.path
+		}
+		if b.label != "" {
+			entry["label"] = b.label
+		}
+		entries = append(entries, entry)
+	}
+	if result.HasErrors() {
+		if len(entries) == 0 {
+			path := []interface{}{}
+			for _, k := range b.path {
+				path = append(path, k)
+			}
+			entries = append(entries, map[string]interface{}{"data": nil, "path": path})
+		}
+		entries[0]["errors"] = result.Errors
+	}
+	return entries, items
+}
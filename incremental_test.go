@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+func TestSliceList(t *testing.T) {
+	list := []*Ride{NewRide(1), NewRide(2), NewRide(3)}
+	for _, c := range []struct {
+		rng  itemRange
+		want []*Ride
+	}{
+		{itemRange{0, 2}, list[:2]},
+		{itemRange{2, 3}, list[2:]},
+		{itemRange{3, 4}, []*Ride{}},
+		{itemRange{0, 10}, list},
+	} {
+		if got := sliceList(list, c.rng); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%+v: %v, want %v", c.rng, got, c.want)
+		}
+	}
+	if got := sliceList(nil, itemRange{0, 1}); got != nil {
+		t.Errorf("nil list is sliced to %v", got)
+	}
+}
+
+// multipartReader reads parts written by multipartWriter
+type multipartReader struct {
+	r *bufio.Reader
+}
+
+func (m *multipartReader) next() (map[string]interface{}, error) {
+	for {
+		line, err := m.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == "-----\r\n" {
+			return nil, io.EOF
+		}
+		if line == "---\r\n" {
+			break
+		}
+	}
+	for { // part headers
+		line, err := m.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if line == "\r\n" {
+			break
+		}
+	}
+	var payload map[string]interface{}
+	d := json.NewDecoder(m.r)
+	if err := d.Decode(&payload); err != nil {
+		return nil, err
+	}
+	m.r = bufio.NewReader(io.MultiReader(d.Buffered(), m.r))
+	return payload, nil
+}
+
+func TestStreamInitialCount(t *testing.T) {
+	release := make(chan struct{})
+	item := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Item",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{Type: graphql.Int, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source, nil
+			}},
+			"slow": &graphql.Field{Type: graphql.String, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				if p.Source.(int) > 0 {
+					<-release // the first item is fast, the rest are not
+				}
+				return fmt.Sprintf("slow %d", p.Source), nil
+			}},
+		},
+	})
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{"items": &graphql.Field{
+			Type:    graphql.NewList(item),
+			Resolve: func(graphql.ResolveParams) (interface{}, error) { return []int{0, 1, 2}, nil },
+		}},
+	})
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query:      query,
+		Directives: append(append([]*graphql.Directive{}, graphql.SpecifiedDirectives...), deferDirective, streamDirective),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamResolvers(&schema)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !serveIncremental(&schema, w, r) {
+			t.Error("request is not served incrementally")
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(`{ items @stream(initialCount: 1) { id slow } }`))
+	req.Header.Set("Content-Type", "application/graphql")
+	req.Header.Set("Accept", "multipart/mixed")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	m := &multipartReader{r: bufio.NewReader(resp.Body)}
+
+	initial := make(chan map[string]interface{}, 1)
+	go func() {
+		p, err := m.next()
+		if err != nil {
+			t.Error(err)
+		}
+		initial <- p
+	}()
+	var p map[string]interface{}
+	select {
+	case p = <-initial:
+	case <-time.After(3 * time.Second):
+		t.Fatal("initial part waits for streamed items")
+	}
+	if got, _ := json.Marshal(p); string(got) != `{"data":{"items":[{"id":0,"slow":"slow 0"}]},"hasNext":true}` {
+		t.Errorf("initial part %s", got)
+	}
+
+	release <- struct{}{} // item 1 only, item 2 still waits
+	p, err = m.next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := json.Marshal(p); string(got) != `{"hasNext":true,"incremental":[{"items":[{"id":1,"slow":"slow 1"}],"path":["items",1]}]}` {
+		t.Errorf("second part %s", got)
+	}
+}
+
+func TestDefer(t *testing.T) {
+	schema := serviceSchema(t)
+	streamResolvers(schema)
+	instrumentResolvers(schema)
+	server := httptest.NewServer(handlerWrapper(nil, schema))
+	defer server.Close()
+
+	query := `{ x_ride(id: 1) { id customer { name ... on Customer @defer(label: "rides") { rides { id } } } } }` // customer is non-null, graphql-go rejects untyped fragment there
+	req, _ := http.NewRequest(http.MethodPost, server.URL, strings.NewReader(query))
+	req.Header.Set("Content-Type", "application/graphql")
+	req.Header.Set("Accept", "multipart/mixed")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/mixed") {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("content type %q: %s", ct, b)
+	}
+	m := &multipartReader{r: bufio.NewReader(resp.Body)}
+	for i, want := range []string{
+		`{"data":{"x_ride":{"customer":{"name":"Customer_100"},"id":1}},"hasNext":true}`,
+		`{"hasNext":false,"incremental":[{"data":{"rides":[{"id":1},{"id":2},{"id":3}]},"label":"rides","path":["x_ride","customer"]}]}`,
+	} {
+		p, err := m.next()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		if got, _ := json.Marshal(p); string(got) != want {
+			t.Errorf("part %d %s, want %s", i, got, want)
+		}
+	}
+	if p, err := m.next(); err != io.EOF {
+		t.Errorf("part after the last one %v, %v", p, err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"regexp"
+
+	"github.com/graph-gophers/dataloader"
+	"github.com/graphql-go/graphql"
+)
+
+// ----- instrumentation -----
+
+// Instrument observes resolvers, loader batches and sql statements.
+// Every hook gets context and returns context for nested work (it can be enriched, span for instance)
+// and function to be called on finish. Any hook can be nil.
+
+type Instrument struct {
+	Field func(ctx context.Context, info graphql.ResolveInfo) (context.Context, func(err error))
+	Batch func(ctx context.Context, loader string, size int) (context.Context, func())
+	SQL   func(ctx context.Context, query string) (context.Context, func(rows int, err error))
+}
+
+var instruments []Instrument
+
+var (
+	sqlLiteralRe = regexp.MustCompile(`'(?:[^']|'')*'|"(?:[^"]|"")*"|\b\d+(?:\.\d+)?\b`)
+	sqlInListRe  = regexp.MustCompile(`(?i)\bin\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+)
+
+// sqlTemplate strips values from statement, it is safe to be shown and good to group statements by.
+// Loaders put keys right into statements, so "where id in (1, 2, 3)" turns to "where id in (?)".
+func sqlTemplate(query string) string {
+	return sqlInListRe.ReplaceAllString(sqlLiteralRe.ReplaceAllString(query, "?"), "in (?)")
+}
+
+func startField(ctx context.Context, info graphql.ResolveInfo) (context.Context, func(err error)) {
+	var finishers []func(error)
+	for _, i := range instruments {
+		if i.Field != nil {
+			var f func(error)
+			ctx, f = i.Field(ctx, info)
+			finishers = append(finishers, f)
+		}
+	}
+	return ctx, func(err error) {
+		for i := len(finishers) - 1; i >= 0; i-- {
+			finishers[i](err)
+		}
+	}
+}
+
+func startBatch(ctx context.Context, loader string, size int) (context.Context, func()) {
+	var finishers []func()
+	for _, i := range instruments {
+		if i.Batch != nil {
+			var f func()
+			ctx, f = i.Batch(ctx, loader, size)
+			finishers = append(finishers, f)
+		}
+	}
+	return ctx, func() {
+		for i := len(finishers) - 1; i >= 0; i-- {
+			finishers[i]()
+		}
+	}
+}
+
+func startSQL(ctx context.Context, query string) (context.Context, func(rows int, err error)) {
+	var finishers []func(int, error)
+	for _, i := range instruments {
+		if i.SQL != nil {
+			var f func(int, error)
+			ctx, f = i.SQL(ctx, query)
+			finishers = append(finishers, f)
+		}
+	}
+	return ctx, func(rows int, err error) {
+		for i := len(finishers) - 1; i >= 0; i-- {
+			finishers[i](rows, err)
+		}
+	}
+}
+
+func instrumentBatch(loader string, fn dataloader.BatchFunc) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		ctx, finish := startBatch(ctx, loader, len(keys))
+		defer finish()
+		return fn(ctx, keys)
+	}
+}
+
+// instrumentField wraps resolver; if resolver returns thunk, field is considered finished when thunk is done
+func instrumentField(resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (interface{}, error) {
+		ctx, finish := startField(p.Context, p.Info)
+		p.Context = ctx
+		result, err := resolve(p)
+		if err != nil {
+			finish(err)
+			return result, err
+		}
+		if thunk, ok := result.(func() (interface{}, error)); ok {
+			return func() (interface{}, error) {
+				r, err := thunk()
+				finish(err)
+				return r, err
+			}, nil
+		}
+		finish(nil)
+		return result, nil
+	}
+}
+
+// instrumentResolvers wraps resolvers of all fields of all object types of schema (except introspection);
+// resolvers and subscribe functions are protected from panics as well, instruments see panics as errors
+func instrumentResolvers(schema *graphql.Schema) {
+	for name, t := range schema.TypeMap() {
+		object, ok := t.(*graphql.Object)
+		if !ok || len(name) > 1 && name[:2] == "__" {
+			continue
+		}
+		for _, f := range object.Fields() {
+			resolve := f.Resolve
+			if resolve == nil {
+				resolve = graphql.DefaultResolveFn // it calls Resolve of business objects
+			}
+			f.Resolve = instrumentField(recoveringField(resolve))
+			if f.Subscribe != nil {
+				f.Subscribe = recoveringField(f.Subscribe) // library drops panics of subscribe function silently
+			}
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ----- lifecycle -----
+
+// Server stops on SIGINT or SIGTERM (the second signal kills process):
+// readiness probe fails for timeouts.drain (load balancer stops sending requests), then server stops accepting
+// connections, waits for in-flight requests (up to timeouts.shutdown), asks long living streams to finish
+// (websocket is closed with 1001 going away, event stream is ended, clients reconnect to another instance),
+// then waits for database connections and closes database.
+// Streams are not restricted by timeouts.write, they clear their deadlines.
+
+// TimeoutsConfig is config.Timeouts
+type TimeoutsConfig struct {
+	Read     time.Duration `config:"read" env:"READ_TIMEOUT" help:"max duration of reading request"`
+	Write    time.Duration `config:"write" env:"WRITE_TIMEOUT" help:"max duration of request (streams are not restricted)"`
+	Idle     time.Duration `config:"idle" env:"IDLE_TIMEOUT" help:"keep-alive connection is closed after"`
+	Drain    time.Duration `config:"drain" env:"DRAIN_DELAY" help:"readiness fails for this time before server stops accepting connections"`
+	Shutdown time.Duration `config:"shutdown" env:"SHUTDOWN_TIMEOUT" help:"max duration of graceful shutdown"`
+}
+
+var (
+	shuttingDown atomic.Bool           // set on signal, see readiness
+	stopping     = make(chan struct{}) // closed when server stops accepting connections
+	stoppingMu   sync.Mutex
+	streams      sync.WaitGroup // websockets; server does not track hijacked connections
+)
+
+func stopStreams() {
+	stoppingMu.Lock()
+	defer stoppingMu.Unlock()
+	select {
+	case <-stopping:
+	default:
+		close(stopping)
+	}
+}
+
+// unlimitedStream removes write deadline (and read deadline if connection is to be hijacked) set by server
+func unlimitedStream(w http.ResponseWriter, read bool) {
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+	if read {
+		rc.SetReadDeadline(time.Time{})
+	}
+}
+
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:         config.Listen,
+		Handler:      handler,
+		ReadTimeout:  config.Timeouts.Read,
+		WriteTimeout: config.Timeouts.Write,
+		IdleTimeout:  config.Timeouts.Idle,
+		ErrorLog:     slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// runServer serves until signal and shuts server down; error means server could not start or stop in time
+func runServer(server *http.Server) error {
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server.RegisterOnShutdown(stopStreams)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.Serve(ln)
+	}()
+	slog.Info("listening", "address", ln.Addr().String())
+	select {
+	case err := <-failed:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+	shuttingDown.Store(true)
+	slog.Info("shutting down", "drain", config.Timeouts.Drain, "timeout", config.Timeouts.Shutdown)
+	time.Sleep(config.Timeouts.Drain)
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeouts.Shutdown)
+	defer cancel()
+	err = server.Shutdown(ctx) // in-flight requests and event streams
+	if err == nil {
+		err = waitStreams(ctx)
+	}
+	if dbErr := shutdownDatabase(ctx); err == nil {
+		err = dbErr
+	}
+	return err
+}
+
+func waitStreams(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		streams.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// freeAddress returns address to listen on; runServer listens by itself
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	prev := *config
+	t.Cleanup(func() {
+		*config = prev
+		shuttingDown.Store(false)
+		databaseClosed.Store(false)
+		stoppingMu.Lock()
+		stopping = make(chan struct{})
+		stoppingMu.Unlock()
+	})
+	config.Listen = freeAddress(t)
+	config.Timeouts = TimeoutsConfig{Read: time.Second, Write: 5 * time.Second, Shutdown: 5 * time.Second}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "done")
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- runServer(newServer(mux))
+	}()
+
+	type response struct {
+		status int
+		body   string
+		err    error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		for i := 0; ; i++ { // wait for server to listen
+			resp, err := http.Get("http://" + config.Listen + "/slow")
+			if err != nil && i < 100 {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			if err != nil {
+				responses <- response{err: err}
+				return
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			responses <- response{status: resp.StatusCode, body: string(body), err: err}
+			return
+		}
+	}()
+	select {
+	case <-started:
+	case r := <-responses:
+		t.Fatalf("request is not started: %v", r.err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("request is not started")
+	}
+
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	refused := false
+	for deadline := time.Now().Add(3 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		c, err := net.DialTimeout("tcp", config.Listen, 100*time.Millisecond)
+		if err != nil {
+			refused = true
+			break
+		}
+		c.Close()
+	}
+	if !refused {
+		t.Error("new connections are accepted while shutting down")
+	}
+	if !shuttingDown.Load() {
+		t.Error("readiness is not failed while shutting down")
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("server stopped before in-flight request is done: %v", err)
+	default:
+	}
+
+	close(release)
+	r := <-responses
+	if r.err != nil || r.status != http.StatusOK || r.body != "done" {
+		t.Errorf("in-flight request: status %d, body %q, error %v", r.status, r.body, r.err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("shutdown failed: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("server is not stopped")
+	}
+	select {
+	case <-stopping:
+	default:
+		t.Error("streams are not asked to stop")
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// ----- query depth and complexity limits -----
+
+// Analysis runs before execution.
+// Cost of field is fieldCosts[Type.field], or 1 for fields of object types, or 0 for scalars.
+// Cost of subselection of list field is multiplied by expected list size: first/limit argument or DefaultListSize;
+// every item of list with first/limit argument costs at least 1 (even if it has scalars only).
+// Connection (not list field with first/limit, like searchRides) passes its size to its edges/nodes lists.
+// Costs are saturated at maxCost, so huge sizes can not overflow.
+// Introspection fields are not taken into account, they are cheap (and GraphiQL queries them deeply).
+
+// QueryLimits are config.Limits
+type QueryLimits struct {
+	MaxDepth        int `config:"max_depth" env:"MAX_QUERY_DEPTH" help:"max depth of operation, 0 means no limit"`
+	MaxCost         int `config:"max_cost" env:"MAX_QUERY_COST" help:"max cost of operation, 0 means no limit"`
+	DefaultListSize int `config:"default_list_size" help:"expected size of list without first/limit argument"`
+	MaxBatchSize    int `config:"max_batch_size" env:"MAX_BATCH_SIZE" help:"max operations in batch, 0 means no limit"`
+}
+
+// fieldCosts are for fields that are more expensive than one loader call
+var fieldCosts = map[string]int{
+	"Query.search":          10, // like over three tables
+	"Query.searchRides":     5,
+	"Stats.totalRides":      2,
+	"Stats.topDestinations": 5,
+	"Stats.busiestDrivers":  5,
+}
+
+// listSizeArguments limit size of lists
+var listSizeArguments = []string{"first", "limit"}
+
+// connectionLists are lists of connection, they are sized by connection field
+var connectionLists = map[string]bool{"edges": true, "nodes": true}
+
+// maxCost is far beyond any sensible limit and it can be doubled without overflow
+const maxCost = 1 << 30
+
+func addCost(a, b int) int {
+	return min(a+b, maxCost)
+}
+
+func mulCost(a, b int) int {
+	if a != 0 && b > maxCost/a {
+		return maxCost
+	}
+	return min(a*b, maxCost)
+}
+
+type costAnalysis struct {
+	schema         *graphql.Schema
+	fragments      map[string]*ast.FragmentDefinition
+	variables      map[string]interface{}
+	visiting       map[string]bool // fragment cycles are reported by validation, but analysis runs before
+	connectionSize int             // size of connection being analysed, 0 if parent field is not connection
+}
+
+// checkQueryLimits returns error if operation is too deep or too expensive;
+// unparsable query is not checked, handler reports errors
+func checkQueryLimits(schema *graphql.Schema, query string, operationName string, variables map[string]interface{}) error {
+	doc, err := parsedDocument(query)
+	if err != nil {
+		return nil
+	}
+	a := &costAnalysis{
+		schema:    schema,
+		fragments: map[string]*ast.FragmentDefinition{},
+		variables: variables,
+		visiting:  map[string]bool{},
+	}
+	var operation *ast.OperationDefinition
+	for _, d := range doc.Definitions {
+		switch n := d.(type) {
+		case *ast.OperationDefinition:
+			if operationName == "" || (n.Name != nil && n.Name.Value == operationName) {
+				operation = n
+			}
+		case *ast.FragmentDefinition:
+			a.fragments[n.Name.Value] = n
+		}
+	}
+	if operation == nil {
+		return nil
+	}
+	var root graphql.Type
+	switch operation.Operation {
+	case ast.OperationTypeQuery:
+		root = schema.QueryType()
+	case ast.OperationTypeMutation:
+		root = schema.MutationType()
+	case ast.OperationTypeSubscription:
+		root = schema.SubscriptionType()
+	}
+	depth, cost := a.selectionSet(operation.SelectionSet, root)
+	if config.Limits.MaxDepth > 0 && depth > config.Limits.MaxDepth {
+		return ValidationError("Query depth %d exceeds limit %d", depth, config.Limits.MaxDepth).
+			WithDetail("depth", depth).
+			WithDetail("maxDepth", config.Limits.MaxDepth)
+	}
+	if config.Limits.MaxCost > 0 && cost > config.Limits.MaxCost {
+		return ValidationError("Query cost %d exceeds limit %d", cost, config.Limits.MaxCost).
+			WithDetail("cost", cost).
+			WithDetail("maxCost", config.Limits.MaxCost)
+	}
+	return nil
+}
+
+func fieldsOf(t graphql.Type) graphql.FieldDefinitionMap {
+	switch t := t.(type) {
+	case *graphql.Object:
+		return t.Fields()
+	case *graphql.Interface:
+		return t.Fields()
+	}
+	return nil // unions have __typename only
+}
+
+// namedType strips lists and non-nulls
+func namedType(t graphql.Type) graphql.Type {
+	n, _ := graphql.GetNamed(t).(graphql.Type)
+	return n
+}
+
+func (a *costAnalysis) selectionSet(set *ast.SelectionSet, parent graphql.Type) (depth int, cost int) {
+	if set == nil {
+		return 0, 0
+	}
+	for _, s := range set.Selections {
+		var d, c int
+		switch s := s.(type) {
+		case *ast.Field:
+			d, c = a.field(s, parent)
+		case *ast.InlineFragment:
+			t := parent
+			if s.TypeCondition != nil {
+				t = a.schema.Type(s.TypeCondition.Name.Value)
+			}
+			d, c = a.selectionSet(s.SelectionSet, t)
+		case *ast.FragmentSpread:
+			name := s.Name.Value
+			f, ok := a.fragments[name]
+			if !ok || a.visiting[name] {
+				continue
+			}
+			a.visiting[name] = true
+			d, c = a.selectionSet(f.SelectionSet, a.schema.Type(f.TypeCondition.Name.Value))
+			delete(a.visiting, name)
+		}
+		if d > depth {
+			depth = d
+		}
+		cost = addCost(cost, c)
+	}
+	return depth, cost
+}
+
+func (a *costAnalysis) field(f *ast.Field, parent graphql.Type) (depth int, cost int) {
+	name := f.Name.Value
+	if strings.HasPrefix(name, "__") {
+		return 0, 0
+	}
+	def, ok := fieldsOf(parent)[name]
+	if !ok {
+		return 1, 0 // unknown field is reported by validation
+	}
+	_, isList := graphql.GetNullable(def.Type).(*graphql.List)
+	size, sized := a.sizeArgument(f)
+	if !sized && isList && connectionLists[name] && a.connectionSize > 0 {
+		size, sized = a.connectionSize, true
+	}
+	outer := a.connectionSize
+	a.connectionSize = 0
+	if sized && !isList {
+		a.connectionSize = size
+	}
+	depth, childCost := a.selectionSet(f.SelectionSet, namedType(def.Type))
+	a.connectionSize = outer
+	cost, ok = fieldCosts[parent.Name()+"."+name]
+	if !ok && f.SelectionSet != nil {
+		cost = 1
+	}
+	switch {
+	case isList && sized:
+		childCost = mulCost(max(childCost, 1), size)
+	case isList:
+		childCost = mulCost(childCost, config.Limits.DefaultListSize)
+	}
+	return depth + 1, addCost(cost, childCost)
+}
+
+// sizeArgument returns first/limit argument of field
+func (a *costAnalysis) sizeArgument(f *ast.Field) (int, bool) {
+	for _, arg := range f.Arguments {
+		for _, name := range listSizeArguments {
+			if arg.Name.Value != name {
+				continue
+			}
+			switch v := arg.Value.(type) {
+			case *ast.IntValue:
+				if n, err := strconv.Atoi(v.Value); err == nil && n >= 0 {
+					return n, true
+				} else if err != nil {
+					return maxCost, true // out of int range
+				}
+			case *ast.Variable:
+				switch n := a.variables[v.Name.Value].(type) {
+				case float64: // json number
+					if n >= 0 {
+						return int(min(n, maxCost)), true
+					}
+				case int:
+					if n >= 0 {
+						return n, true
+					}
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// rejectedResult is response for operation that is not to be executed
+func rejectedResult(ctx context.Context, err error) *graphql.Result {
+	errs := []gqlerrors.FormattedError{formatError(err)}
+	addRequestId(ctx, errs)
+	return &graphql.Result{Errors: errs}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+)
+
+func testSchema(t *testing.T) *graphql.Schema {
+	t.Helper()
+	ride := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Ride",
+		Fields: graphql.Fields{
+			"id":          &graphql.Field{Type: graphql.Int},
+			"destination": &graphql.Field{Type: graphql.String},
+		},
+	})
+	destination := graphql.NewObject(graphql.ObjectConfig{
+		Name: "DestinationStat",
+		Fields: graphql.Fields{
+			"destination": &graphql.Field{Type: graphql.String},
+			"ridesCount":  &graphql.Field{Type: graphql.Int},
+			"lastRide":    &graphql.Field{Type: ride},
+		},
+	})
+	edge := graphql.NewObject(graphql.ObjectConfig{
+		Name: "RideSearchEdge",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.String},
+			"node":   &graphql.Field{Type: ride},
+		},
+	})
+	pageInfo := graphql.NewObject(graphql.ObjectConfig{
+		Name:   "PageInfo",
+		Fields: graphql.Fields{"hasNextPage": &graphql.Field{Type: graphql.Boolean}},
+	})
+	connection := graphql.NewObject(graphql.ObjectConfig{
+		Name: "RideSearchConnection",
+		Fields: graphql.Fields{
+			"edges":    &graphql.Field{Type: graphql.NewList(edge)},
+			"pageInfo": &graphql.Field{Type: pageInfo},
+		},
+	})
+	stats := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Stats",
+		Fields: graphql.Fields{
+			"topDestinations": &graphql.Field{
+				Type: graphql.NewList(destination),
+				Args: graphql.FieldConfigArgument{"limit": &graphql.ArgumentConfig{Type: graphql.Int}},
+			},
+		},
+	})
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"searchRides": &graphql.Field{
+				Type: connection,
+				Args: graphql.FieldConfigArgument{
+					"query": &graphql.ArgumentConfig{Type: graphql.String},
+					"first": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+			},
+			"stats": &graphql.Field{Type: stats},
+		},
+	})
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schema
+}
+
+func TestQueryCost(t *testing.T) {
+	schema := testSchema(t)
+	prev := config.Limits
+	config.Limits = QueryLimits{MaxDepth: 12, MaxCost: 1000, DefaultListSize: 10}
+	t.Cleanup(func() { config.Limits = prev })
+	for _, c := range []struct {
+		name      string
+		query     string
+		variables map[string]interface{}
+		rejected  bool
+	}{
+		{"small connection", `{searchRides(query: "a", first: 10) {edges {cursor node {id}}}}`, nil, false},
+		{"large first", `{searchRides(query: "a", first: 100000) {edges {cursor node {id}}}}`, nil, true},
+		{"large first, scalars of edges", `{searchRides(query: "a", first: 100000) {edges {cursor}}}`, nil, true},
+		{"large first in fragment", `{searchRides(query: "a", first: 100000) {...F}} fragment F on RideSearchConnection {edges {node {id}}}`, nil, true},
+		{"large first in variable", `query($n: Int) {searchRides(query: "a", first: $n) {edges {node {id}}}}`, map[string]interface{}{"n": float64(100000)}, true},
+		{"first out of int range", `{searchRides(query: "a", first: 99999999999999999999) {edges {cursor}}}`, nil, true},
+		{"huge first does not overflow", `{searchRides(query: "a", first: 9223372036854775807) {edges {node {id}}}}`, nil, true},
+		{"large first, no edges", `{searchRides(query: "a", first: 100000) {pageInfo {hasNextPage}}}`, nil, false},
+		{"small limit", `{stats {topDestinations(limit: 10) {destination ridesCount}}}`, nil, false},
+		{"large limit", `{stats {topDestinations(limit: 100000) {destination ridesCount}}}`, nil, true},
+		{"negative limit", `{stats {topDestinations(limit: -1) {destination ridesCount}}}`, nil, false},
+		{"negative limit in variable", `query($n: Int) {stats {topDestinations(limit: $n) {destination}}}`, map[string]interface{}{"n": float64(-1)}, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkQueryLimits(schema, c.query, "", c.variables)
+			var e *Error
+			if c.rejected && (!errors.As(err, &e) || e.Code != CodeValidation) {
+				t.Errorf("error %v, want %s", err, CodeValidation)
+			}
+			if !c.rejected && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+}
+
+func TestQueryDepth(t *testing.T) {
+	schema := testSchema(t)
+	prev := config.Limits
+	config.Limits = QueryLimits{MaxDepth: 3}
+	t.Cleanup(func() { config.Limits = prev })
+	for _, c := range []struct {
+		name     string
+		query    string
+		rejected bool
+	}{
+		{"at limit", `{searchRides(query: "a") {pageInfo {hasNextPage}}}`, false},
+		{"over limit", `{searchRides(query: "a") {edges {node {id}}}}`, true},
+		{"introspection fields are not counted", `{searchRides(query: "a") {edges {node {__typename}}}}`, false},
+		{"fragment at limit", `{searchRides(query: "a") {...F}} fragment F on RideSearchConnection {pageInfo {hasNextPage}}`, false},
+		{"fragment over limit", `{searchRides(query: "a") {...F}} fragment F on RideSearchConnection {edges {node {id}}}`, true},
+		{"nested fragments over limit", `{searchRides(query: "a") {...F}} fragment F on RideSearchConnection {edges {...E}} fragment E on RideSearchEdge {node {id}}`, true},
+		{"inline fragment at limit", `{searchRides(query: "a") {... on RideSearchConnection {pageInfo {hasNextPage}}}}`, false},
+		{"inline fragment over limit", `{searchRides(query: "a") {... on RideSearchConnection {edges {node {id}}}}}`, true},
+		{"inline fragment without type over limit", `{searchRides(query: "a") {edges {... {node {id}}}}}`, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			err := checkQueryLimits(schema, c.query, "", nil)
+			var e *Error
+			if c.rejected && (!errors.As(err, &e) || e.Code != CodeValidation || e.Details["maxDepth"] != 3) {
+				t.Errorf("error %v, want %s", err, CodeValidation)
+			}
+			if !c.rejected && err != nil {
+				t.Errorf("unexpected error %v", err)
+			}
+		})
+	}
+	config.Limits.MaxDepth = 0 // no limit
+	if err := checkQueryLimits(schema, `{searchRides(query: "a") {edges {node {id}}}}`, "", nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+// TestNegativeLimit: negative limit is not a size, list costs as if there is no limit; resolver rejects it
+func TestNegativeLimit(t *testing.T) {
+	schema := testSchema(t)
+	prev := config.Limits
+	config.Limits = QueryLimits{MaxCost: 1, DefaultListSize: 10} // every query is rejected to get its cost
+	t.Cleanup(func() { config.Limits = prev })
+	cost := func(query string) interface{} {
+		var e *Error
+		if err := checkQueryLimits(schema, query, "", nil); !errors.As(err, &e) {
+			t.Fatalf("%s: error %v", query, err)
+		}
+		return e.Details["cost"]
+	}
+	// stats 1 + topDestinations 5 + default list size 10 of lastRide 1
+	for _, query := range []string{
+		`{stats {topDestinations {lastRide {id}}}}`,
+		`{stats {topDestinations(limit: -1) {lastRide {id}}}}`,
+	} {
+		if got := cost(query); got != 16 {
+			t.Errorf("%s: cost %v, want 16", query, got)
+		}
+	}
+
+	config.Limits = prev
+	if got := execute(serviceSchema(t), &Principal{Role: RoleAdmin}, `{stats {topDestinations(limit: -1) {destination}}}`); !strings.Contains(got, `"code":"VALIDATION"`) {
+		t.Errorf("result %s", got)
+	}
+}
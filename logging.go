@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/mxk/go-sqlite/sqlite3"
+)
+
+// ----- logging -----
+
+// LogConfig is config.Log
+type LogConfig struct {
+	Format string `config:"format" env:"LOG_FORMAT" help:"pretty (for development) or json (for production)"`
+	Level  string `config:"level" env:"LOG_LEVEL" help:"debug, info, warn or error"`
+	Rows   bool   `config:"rows" env:"LOG_ROWS" help:"log result rows of sql statements; off by default to keep PII out of logs"`
+}
+
+func setupLogging(c LogConfig) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(c.Level)); err != nil {
+		return fmt.Errorf("Invalid log level %q: %w", c.Level, err)
+	}
+	var h slog.Handler
+	switch c.Format {
+	case "pretty":
+		h = newPrettyHandler(os.Stdout, l)
+	case "json":
+		h = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: l})
+	default:
+		return fmt.Errorf("Unknown log format %q", c.Format)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+	return nil
+}
+
+type logAttrsKey struct{}
+
+// withLogAttrs adds attributes to every record logged with returned context (request id, operation name...)
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	prev, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	return context.WithValue(ctx, logAttrsKey{}, append(append([]slog.Attr{}, prev...), attrs...))
+}
+
+// contextHandler takes attributes from context, see withLogAttrs
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// prettyHandler writes colored human readable lines
+type prettyHandler struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string // of group
+}
+
+func newPrettyHandler(w io.Writer, level slog.Leveler) *prettyHandler {
+	return &prettyHandler{mu: &sync.Mutex{}, w: w, level: level}
+}
+
+var levelColors = map[slog.Level]string{
+	slog.LevelDebug: "\x1b[1;34m",
+	slog.LevelInfo:  "\x1b[1;32m",
+	slog.LevelWarn:  "\x1b[1;33m",
+	slog.LevelError: "\x1b[1;31m",
+}
+
+func (h *prettyHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *prettyHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Time.Format("15:04:05.000"))
+	fmt.Fprintf(&b, " %s%-5s\x1b[0m \x1b[1m%s\x1b[0m", levelColors[r.Level], r.Level, r.Message)
+	for _, a := range h.attrs {
+		writePrettyAttr(&b, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writePrettyAttr(&b, h.prefix, a)
+		return true
+	})
+	b.WriteString("\n")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+func writePrettyAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		for _, g := range v.Group() {
+			writePrettyAttr(b, prefix+a.Key+".", g)
+		}
+		return
+	}
+	if rows, ok := v.Any().([]sqlite3.RowMap); ok { // result rows, one per line
+		for i, r := range rows {
+			fmt.Fprintf(b, "\n\x1b[1;33m%4d\x1b[0m %v", i, r)
+		}
+		return
+	}
+	fmt.Fprintf(b, " %s%s=\x1b[1;32m%v\x1b[0m", prefix, a.Key, v)
+}
+
+func (h *prettyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	n := *h
+	n.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		n.attrs = append(n.attrs, slog.Attr{Key: h.prefix + a.Key, Value: a.Value})
+	}
+	return &n
+}
+
+func (h *prettyHandler) WithGroup(name string) slog.Handler {
+	n := *h
+	n.prefix = h.prefix + name + "."
+	return &n
+}
+
+// logResult logs statement without values; rows are logged on demand only
+func logResult(ctx context.Context, sql string, result []sqlite3.RowMap, duration time.Duration, err error) {
+	attrs := []any{
+		slog.String("sql", sqlTemplate(sql)),
+		slog.Int("rows", len(result)),
+		slog.Duration("duration", duration),
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "sql failed", append(attrs, slog.String("error", err.Error()))...)
+		return
+	}
+	if config.Log.Rows {
+		attrs = append(attrs, slog.Any("result", result))
+	}
+	slog.InfoContext(ctx, "sql", attrs...)
+}
+
+// loggingExtension puts operation name into log records of request
+type loggingExtension struct{}
+
+func (loggingExtension) Init(ctx context.Context, p *graphql.Params) context.Context {
+	return withLogAttrs(ctx, slog.String("operation", p.OperationName))
+}
+
+func (loggingExtension) Name() string { return "logging" }
+
+func (loggingExtension) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+	return ctx, func(error) {}
+}
+
+func (loggingExtension) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+	return ctx, func([]gqlerrors.FormattedError) {}
+}
+
+func (loggingExtension) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+	return ctx, func(*graphql.Result) {}
+}
+
+func (loggingExtension) ResolveFieldDidStart(ctx context.Context, i *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+	return ctx, func(interface{}, error) {}
+}
+
+func (loggingExtension) HasResult() bool { return false }
+
+func (loggingExtension) GetResult(context.Context) interface{} { return nil }
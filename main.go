@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/graph-gophers/dataloader"
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/handler"
@@ -18,37 +28,63 @@ import (
 
 // ----- draft sql interface -----
 
-const DATABASE = "database.db"
-
 func errorString(prefix string, sql string, err error) string {
-	return fmt.Sprintf("%s [%s] %s: %s", prefix, DATABASE, sql, err.Error())
+	return fmt.Sprintf("%s [%s] %s: %s", prefix, config.Database, sql, err.Error())
 }
 
-func logResult(sql string, result []sqlite3.RowMap) {
-	fmt.Printf("\x1b[1m%s\x1b[0m:\n", sql)
-	for i, r := range result {
-		fields := make([]string, len(r))
-		j := 0
-		for k, v := range r {
-			fields[j] = fmt.Sprintf("%s=\x1b[1;32m%v\x1b[0m", k, v)
-			j += 1
+var databaseClosed atomic.Bool
+
+// openDatabase opens connection; use closeDatabase to close it, they keep db_open_connections metric
+func openDatabase() (*sqlite3.Conn, error) {
+	if databaseClosed.Load() {
+		return nil, errors.New("database is closed")
+	}
+	c, err := sqlite3.Open(config.Database)
+	if err == nil {
+		atomic.AddInt64(&openConnections, 1)
+	}
+	return c, err
+}
+
+func closeDatabase(c *sqlite3.Conn) {
+	c.Close()
+	atomic.AddInt64(&openConnections, -1)
+}
+
+// shutdownDatabase waits for open connections and refuses new ones
+func shutdownDatabase(ctx context.Context) error {
+	databaseClosed.Store(true)
+	for atomic.LoadInt64(&openConnections) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
 		}
-		sort.Strings(fields)
-		fmt.Printf("\x1b[1;33m%4d\x1b[0m %s\n", i, strings.Join(fields, " "))
 	}
+	return nil
 }
 
-func sql(sql string) []sqlite3.RowMap {
+// sql runs statement; args (if any) are bound to ? placeholders
+func sql(ctx context.Context, sql string, args ...interface{}) []sqlite3.RowMap {
 	var result []sqlite3.RowMap
-	c, err := sqlite3.Open(DATABASE)
+	start := time.Now()
+	_, done := startSQL(ctx, sql)
+	finish := func(err error) {
+		done(len(result), err)
+		logResult(ctx, sql, result, time.Since(start), err)
+	}
+	c, err := openDatabase()
 	if err != nil {
+		finish(err)
 		panic(errorString("open", sql, err))
 	}
-	s, err := c.Query(sql)
+	s, err := c.Query(sqlWithRequestId(ctx, sql), args...)
 	for {
 		if err == io.EOF {
 			break
 		} else if err != nil {
+			finish(err)
+			closeDatabase(c)
 			panic(errorString("fetch", sql, err))
 		}
 		row := make(sqlite3.RowMap)
@@ -57,8 +93,8 @@ func sql(sql string) []sqlite3.RowMap {
 		err = s.Next()
 	}
 	c.Commit()
-	c.Close()
-	logResult(sql, result)
+	closeDatabase(c)
+	finish(nil)
 	return result
 }
 
@@ -66,27 +102,114 @@ func sql(sql string) []sqlite3.RowMap {
 
 type gtHandler struct {
 	origHandler http.Handler
+	schema      *graphql.Schema
 }
 
 func (h *gtHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// you can set you own header for tracing etc
-	w.Header().Add("X-Michurin", "Here!")
-	// hacks for graphql-cli
-	if origin := r.Header.Get("Origin"); origin != "" {
-		w.Header().Add("Access-Control-Allow-Origin", origin)
-	}
-	w.Header().Add("Access-Control-Allow-Headers", "Content-Type,X-Apollo-Tracing")
-	if r.Method == http.MethodOptions {
+	r, span := startHTTPSpan(r)
+	defer span.End()
+	r = r.WithContext(withRequestId(r.Context(), requestIdFromRequest(r)))
+	w.Header().Set(requestIdHeader, requestIdFromContext(r.Context()))
+	defer recoverHTTP(w, r)
+	if websocket.IsWebSocketUpgrade(r) {
+		// subscriptions (and any other operations) over graphql-transport-ws
+		serveWebSocket(h.schema, w, r)
+		return
+	}
+	if withCORS(w, r) {
+		// preflight is answered
+	} else if r.Method == http.MethodOptions {
 		// just call for schema
 		h.origHandler.ServeHTTP(w, r)
+	} else if r, ok := withAuthentication(w, r); !ok {
+		// credentials are invalid or required, error is sent
+	} else if r, ok := withPersistedQuery(w, r); !ok {
+		// persisted query is not found or not allowed, error is sent
+	} else if !withSafeGET(w, r) {
+		// mutation sent by GET, error is sent
+	} else if isEventStreamRequest(r) {
+		// subscriptions (and any other operations) over graphql-sse
+		serveEventStream(h.schema, w, r)
+	} else {
+		withRequestMetrics(w, r, h.serveOperation)
+	}
+}
+
+func (h *gtHandler) serveOperation(w http.ResponseWriter, r *http.Request) {
+	if !isBatchRequest(r) {
+		opts := peekRequestOptions(r)
+		if err := checkQueryLimits(h.schema, opts.Query, opts.OperationName, opts.Variables); err != nil {
+			writeResult(w, r, http.StatusOK, rejectedResult(r.Context(), err))
+			return
+		}
+		if serveIncremental(h.schema, w, r) {
+			// @defer and @stream, multipart/mixed response is streamed, it is not compressed
+			return
+		}
+	}
+	withCompression(w, r, h.serveBuffered)
+}
+
+func (h *gtHandler) serveBuffered(w http.ResponseWriter, r *http.Request) {
+	if isBatchRequest(r) {
+		// array of operations, apollo-link-batch-http
+		serveBatch(h.schema, w, r)
+	} else if r.Method == http.MethodGet && !wantsGraphiQL(r) {
+		// queries (mutations are rejected by withSafeGET) to be cached by browsers and CDNs
+		withCacheHeaders(h.schema, w, r, h.serveTraced)
+	} else {
+		h.serveTraced(w, r)
+	}
+}
+
+func (h *gtHandler) serveTraced(w http.ResponseWriter, r *http.Request) {
+	if wantsTracing(r) {
+		withTracing(w, r, h.serve)
 	} else {
-		// fill request context
-		h.origHandler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "dataloaders", NewLoaders())))
+		h.serve(w, r)
+	}
+}
+
+func (h *gtHandler) serve(w http.ResponseWriter, r *http.Request) {
+	// fill request context
+	ctx := context.WithValue(r.Context(), "dataloaders", NewLoaders())
+	if wantsGraphiQL(r) {
+		h.origHandler.ServeHTTP(w, r.WithContext(ctx))
+		return
 	}
+	// the same as original handler does, but parsed documents are cached
+	opts := handler.NewRequestOptions(r)
+	result := executeQuery(graphql.Params{
+		Schema:         *h.schema,
+		RequestString:  opts.Query,
+		VariableValues: opts.Variables,
+		OperationName:  opts.OperationName,
+		Context:        ctx,
+	})
+	writeResult(w, r, http.StatusOK, result)
 }
 
-func handlerWrapper(h http.Handler) *gtHandler {
-	return &gtHandler{h}
+// wantsGraphiQL is the rule of original handler to show GraphiQL or Playground
+func wantsGraphiQL(r *http.Request) bool {
+	if !config.GraphiQL && !config.Playground {
+		return false
+	}
+	_, raw := r.URL.Query()["raw"]
+	accept := r.Header.Get("Accept")
+	return r.Method == http.MethodGet && !raw && !strings.Contains(accept, "application/json") && strings.Contains(accept, "text/html")
+}
+
+func handlerWrapper(h http.Handler, schema *graphql.Schema) *gtHandler {
+	return &gtHandler{h, schema}
+}
+
+// peekRequestOptions parses request leaving body to be read again
+func peekRequestOptions(r *http.Request) *handler.RequestOptions {
+	body, _ := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	opts := handler.NewRequestOptions(r)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return opts
 }
 
 // ----- util -----
@@ -119,6 +242,42 @@ func callTrunkGetIdCast(trunk dataloader.Thunk, field string, caster func(int) i
 	}
 }
 
+func callTrunkGetNullableIdCast(trunk dataloader.Thunk, field string, caster func(int) interface{}) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		data, err := trunk()
+		if err != nil {
+			return nil, err
+		}
+		id, ok := data.(sqlite3.RowMap)[field].(int64)
+		if !ok {
+			return nil, nil // NULL in db
+		}
+		return caster(int(id)), nil
+	}
+}
+
+// callTrunkGetCount gets count from aggregate row; there is no row if nothing to count
+func callTrunkGetCount(trunk dataloader.Thunk, field string) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		data, err := trunk()
+		if err != nil {
+			return nil, err
+		}
+		row := data.(sqlite3.RowMap)
+		if row == nil {
+			return 0, nil
+		}
+		return int(row[field].(int64)), nil
+	}
+}
+
+func nullableVehicle(v interface{}) *Vehicle {
+	if id, ok := v.(int64); ok {
+		return NewVehicle(int(id))
+	}
+	return nil
+}
+
 func callTrunkGetCompleteRides(trunk dataloader.Thunk) func() (interface{}, error) {
 	return func() (interface{}, error) {
 		data, err := trunk()
@@ -128,12 +287,7 @@ func callTrunkGetCompleteRides(trunk dataloader.Thunk) func() (interface{}, erro
 		dataArray := data.([]sqlite3.RowMap)
 		r := make([]*CompleteRide, len(dataArray))
 		for i, e := range dataArray {
-			r[i] = &CompleteRide{
-				Id:          int(e["ride_id"].(int64)),
-				Driver:      NewDriver(int(e["driver_id"].(int64))),
-				Customer:    NewCustomer(int(e["customer_id"].(int64))),
-				Destination: e["destination"].(string),
-			}
+			r[i] = NewCompleteRide(e)
 		}
 		return r, nil
 	}
@@ -153,12 +307,29 @@ func callTrunkGetCompleteRidesDeep(trunk dataloader.Thunk) func() (interface{},
 				Driver:      NewDriverWithName(int(e["driver_id"].(int64)), e["name"].(string)),
 				Customer:    NewCustomer(int(e["customer_id"].(int64))),
 				Destination: e["destination"].(string),
+				Vehicle:     nullableVehicle(e["vehicle_id"]),
+				Status:      e["status"].(string),
 			}
 		}
 		return r, nil
 	}
 }
 
+func callTrunkGetCompleteVehicles(trunk dataloader.Thunk) func() (interface{}, error) {
+	return func() (interface{}, error) {
+		data, err := trunk()
+		if err != nil {
+			return nil, err
+		}
+		dataArray := data.([]sqlite3.RowMap)
+		r := make([]*CompleteVehicle, len(dataArray))
+		for i, e := range dataArray {
+			r[i] = NewCompleteVehicle(e)
+		}
+		return r, nil
+	}
+}
+
 // Driver
 // features: two constructors to create prefilled structures, see deep_rides implementation in Customer.Resolve
 
@@ -176,6 +347,12 @@ func NewDriverWithName(id int, name string) *Driver {
 }
 
 func (d *Driver) Resolve(p graphql.ResolveParams) (interface{}, error) {
+	switch p.Info.FieldName {
+	case "rides", "vehicles", "ridesCount":
+		if err := requireSelf(p.Context, RoleDriver, d.id); err != nil {
+			return nil, err
+		}
+	}
 	switch p.Info.FieldName {
 	case "id":
 		return d.id, nil // in fact, it is too lazy, we did not check is this id exists in db
@@ -188,8 +365,14 @@ func (d *Driver) Resolve(p graphql.ResolveParams) (interface{}, error) {
 	case "rides":
 		trunk := getLoaderFnByName(p, "rides_by_driver_id", NewIntKey(d.id))
 		return callTrunkGetCompleteRides(trunk), nil
+	case "vehicles":
+		trunk := getLoaderFnByName(p, "vehicles_by_driver_id", NewIntKey(d.id))
+		return callTrunkGetCompleteVehicles(trunk), nil
+	case "ridesCount":
+		trunk := getLoaderFnByName(p, "rides_count_by_driver_id", NewIntKey(d.id))
+		return callTrunkGetCount(trunk, "rides_count"), nil
 	}
-	return nil, errors.New("Driver resolver: Unknown field " + p.Info.FieldName)
+	return nil, InternalError("Driver resolver: Unknown field %s", p.Info.FieldName)
 }
 
 // Customer
@@ -200,6 +383,12 @@ type Customer struct {
 }
 
 func (c *Customer) Resolve(p graphql.ResolveParams) (interface{}, error) {
+	switch p.Info.FieldName {
+	case "rides", "deep_rides", "ridesCount":
+		if err := requireSelf(p.Context, RoleCustomer, c.id); err != nil {
+			return nil, err
+		}
+	}
 	switch p.Info.FieldName {
 	case "id":
 		return c.id, nil
@@ -212,8 +401,11 @@ func (c *Customer) Resolve(p graphql.ResolveParams) (interface{}, error) {
 	case "deep_rides":
 		trunk := getLoaderFnByName(p, "deep_rides_by_customer_id", NewIntKey(c.id))
 		return callTrunkGetCompleteRidesDeep(trunk), nil
+	case "ridesCount":
+		trunk := getLoaderFnByName(p, "rides_count_by_customer_id", NewIntKey(c.id))
+		return callTrunkGetCount(trunk, "rides_count"), nil
 	}
-	return nil, errors.New("Customer resolver: Unknown field " + p.Info.FieldName)
+	return nil, InternalError("Customer resolver: Unknown field %s", p.Info.FieldName)
 }
 
 func NewCustomer(id int) *Customer {
@@ -245,17 +437,40 @@ func (r *Ride) Resolve(p graphql.ResolveParams) (interface{}, error) {
 	case "customer":
 		trunk := r.getTrunk(p)
 		return callTrunkGetIdCast(trunk, "customer_id", func(id int) interface{} { return NewCustomer(id) }), nil
-	case "destination":
+	case "destination", "status":
 		trunk := r.getTrunk(p)
-		return callTrunkGetByName(trunk, "destination"), nil
+		return callTrunkGetByName(trunk, p.Info.FieldName), nil
+	case "vehicle":
+		trunk := r.getTrunk(p)
+		return callTrunkGetNullableIdCast(trunk, "vehicle_id", func(id int) interface{} { return NewVehicle(id) }), nil
 	}
-	return nil, errors.New("Ride resolver: Unknown field " + p.Info.FieldName)
+	return nil, InternalError("Ride resolver: Unknown field %s", p.Info.FieldName)
 }
 
 func NewRide(id int) *Ride {
 	return &Ride{id: id}
 }
 
+// readableRide resolves to ride if restricted principal can read it (see restrictedPrincipal);
+// unknown ride is reported the same way as foreign one
+func readableRide(p graphql.ResolveParams, principal *Principal, r *Ride) interface{} {
+	if principal == nil {
+		return r
+	}
+	trunk := r.getTrunk(p)
+	return func() (interface{}, error) {
+		data, err := trunk()
+		if err != nil {
+			return nil, err
+		}
+		row, _ := data.(sqlite3.RowMap)
+		if row == nil || !canReadRide(principal, int(row["customer_id"].(int64)), int(row["driver_id"].(int64))) {
+			return nil, ForbiddenError("Ride %d is not available", r.id).WithDetail("ride_id", r.id)
+		}
+		return r, nil
+	}
+}
+
 // Ride: completely resolved
 
 type CompleteRide struct {
@@ -263,6 +478,336 @@ type CompleteRide struct {
 	Driver      *Driver
 	Customer    *Customer
 	Destination string
+	Vehicle     *Vehicle // nil if ride is not assigned to vehicle
+	Status      string
+}
+
+func NewCompleteRide(e sqlite3.RowMap) *CompleteRide {
+	return &CompleteRide{
+		Id:          int(e["ride_id"].(int64)),
+		Driver:      NewDriver(int(e["driver_id"].(int64))),
+		Customer:    NewCustomer(int(e["customer_id"].(int64))),
+		Destination: e["destination"].(string),
+		Vehicle:     nullableVehicle(e["vehicle_id"]),
+		Status:      e["status"].(string),
+	}
+}
+
+// Vehicle
+// features: the same laziness as Ride; retired vehicles are kept in db to keep rides history consistent
+
+type Vehicle struct {
+	id    int
+	trunk dataloader.Thunk
+}
+
+func (v *Vehicle) getTrunk(p graphql.ResolveParams) dataloader.Thunk {
+	if v.trunk == nil {
+		v.trunk = getLoaderFnByName(p, "vehicle", NewIntKey(v.id))
+	}
+	return v.trunk
+}
+
+func (v *Vehicle) Resolve(p graphql.ResolveParams) (interface{}, error) {
+	switch p.Info.FieldName {
+	case "id":
+		return v.id, nil
+	case "driver":
+		trunk := v.getTrunk(p)
+		return callTrunkGetIdCast(trunk, "driver_id", func(id int) interface{} { return NewDriver(id) }), nil
+	case "plate", "make", "model", "seats", "class":
+		trunk := v.getTrunk(p)
+		return callTrunkGetByName(trunk, p.Info.FieldName), nil
+	case "retired":
+		trunk := v.getTrunk(p)
+		return callTrunkGetIdCast(trunk, "retired", func(x int) interface{} { return x != 0 }), nil
+	}
+	return nil, InternalError("Vehicle resolver: Unknown field %s", p.Info.FieldName)
+}
+
+func NewVehicle(id int) *Vehicle {
+	return &Vehicle{id: id}
+}
+
+// Vehicle: completely resolved
+
+type CompleteVehicle struct {
+	Id      int
+	Driver  *Driver
+	Plate   string
+	Make    string
+	Model   string
+	Seats   int
+	Class   string
+	Retired bool
+}
+
+func NewCompleteVehicle(e sqlite3.RowMap) *CompleteVehicle {
+	return &CompleteVehicle{
+		Id:      int(e["vehicle_id"].(int64)),
+		Driver:  NewDriver(int(e["driver_id"].(int64))),
+		Plate:   e["plate"].(string),
+		Make:    e["make"].(string),
+		Model:   e["model"].(string),
+		Seats:   int(e["seats"].(int64)),
+		Class:   e["class"].(string),
+		Retired: e["retired"].(int64) != 0,
+	}
+}
+
+// checkVehicleForRide returns error if ride of driver can not be assigned to vehicle
+func checkVehicleForRide(ctx context.Context, vehicleId int, driverId int) error {
+	res := sql(ctx, "select driver_id, retired from Vehicle where vehicle_id=?", vehicleId)
+	if len(res) == 0 {
+		return NotFoundError("Vehicle %d not found", vehicleId).WithDetail("vehicle_id", vehicleId)
+	}
+	if int(res[0]["driver_id"].(int64)) != driverId {
+		return ValidationError("Vehicle %d is not owned by driver %d", vehicleId, driverId).WithDetail("vehicle_id", vehicleId).WithDetail("driver_id", driverId)
+	}
+	if res[0]["retired"].(int64) != 0 {
+		return ConflictError("Vehicle %d is retired", vehicleId).WithDetail("vehicle_id", vehicleId)
+	}
+	return nil
+}
+
+// Stats
+// features: aggregates over whole db; busiestDrivers primes per-request counters, so ridesCount costs nothing
+
+type Stats struct{}
+
+func (s *Stats) Resolve(p graphql.ResolveParams) (interface{}, error) {
+	switch p.Info.FieldName {
+	case "totalRides":
+		res := sql(p.Context, "select count(*) rides_count from Ride")
+		return int(res[0]["rides_count"].(int64)), nil
+	case "topDestinations":
+		limit, err := statsLimit(p)
+		if err != nil {
+			return nil, err
+		}
+		res := sql(p.Context, "select destination, count(*) rides_count from Ride group by destination order by rides_count desc, destination limit ?", limit)
+		r := make([]*DestinationStat, len(res))
+		for i, e := range res {
+			r[i] = &DestinationStat{
+				Destination: e["destination"].(string),
+				RidesCount:  int(e["rides_count"].(int64)),
+			}
+		}
+		return r, nil
+	case "busiestDrivers":
+		limit, err := statsLimit(p)
+		if err != nil {
+			return nil, err
+		}
+		res := sql(p.Context, "select driver_id, name, count(*) rides_count from Ride join Driver using (driver_id) group by driver_id order by rides_count desc, driver_id limit ?", limit)
+		loader := p.Context.Value("dataloaders").(map[string]*dataloader.Loader)["rides_count_by_driver_id"]
+		r := make([]*Driver, len(res))
+		for i, e := range res {
+			id := int(e["driver_id"].(int64))
+			loader.Prime(p.Context, NewIntKey(id), e)
+			r[i] = NewDriverWithName(id, e["name"].(string))
+		}
+		return r, nil
+	}
+	return nil, InternalError("Stats resolver: Unknown field %s", p.Info.FieldName)
+}
+
+// statsLimit is limit argument; sqlite takes negative limit as no limit, so it is rejected (and query cost is right)
+func statsLimit(p graphql.ResolveParams) (int, error) {
+	limit := p.Args["limit"].(int)
+	if limit < 0 {
+		return 0, ValidationError("Argument limit must be non-negative").WithDetail("argument", "limit")
+	}
+	return limit, nil
+}
+
+type DestinationStat struct {
+	Destination string
+	RidesCount  int
+}
+
+// Search
+// features: one statement per entity type; found customers are primed into loader, so name costs nothing
+
+func likePattern(text string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + r.Replace(text) + "%"
+}
+
+func Search(p graphql.ResolveParams, text string) []interface{} {
+	var r []interface{}
+	pattern := likePattern(text)
+	for _, e := range sql(p.Context, `select * from Driver where name like ? escape '\' order by driver_id`, pattern) {
+		r = append(r, NewDriverWithName(int(e["driver_id"].(int64)), e["name"].(string)))
+	}
+	loader := p.Context.Value("dataloaders").(map[string]*dataloader.Loader)["customer"]
+	for _, e := range sql(p.Context, `select * from Customer where name like ? escape '\' order by customer_id`, pattern) {
+		id := int(e["customer_id"].(int64))
+		loader.Prime(p.Context, NewIntKey(id), e)
+		r = append(r, NewCustomer(id))
+	}
+	for _, e := range sql(p.Context, `select * from Ride where destination like ? escape '\' order by ride_id`, pattern) {
+		r = append(r, NewCompleteRide(e))
+	}
+	return r
+}
+
+// Full-text search
+// features: FTS4 index (see migrations.go) gives ids, snippets and match info only; rides are hydrated by ride loader,
+// fts4 has no ranking and highlighting functions, so bm25 and highlight are computed here
+
+type RideSearchConnection struct {
+	Edges    []*RideSearchEdge
+	PageInfo *PageInfo
+}
+
+type RideSearchEdge struct {
+	Cursor    string
+	Node      *Ride
+	Snippet   string
+	Highlight string
+	Score     float64 // the more the better
+}
+
+type PageInfo struct {
+	HasNextPage bool
+	EndCursor   *string
+}
+
+func offsetToCursor(offset int) string {
+	return base64.StdEncoding.EncodeToString([]byte("offset:" + strconv.Itoa(offset)))
+}
+
+func cursorToOffset(cursor string) (int, error) {
+	b, err := base64.StdEncoding.DecodeString(cursor)
+	if err == nil && strings.HasPrefix(string(b), "offset:") {
+		offset, err := strconv.Atoi(strings.TrimPrefix(string(b), "offset:"))
+		if err == nil && offset >= 0 {
+			return offset, nil
+		}
+	}
+	return 0, ValidationError("Invalid cursor %s", cursor).WithDetail("cursor", cursor)
+}
+
+// ftsQuery turns user text into FTS4 query: every word is quoted phrase (so no syntax errors),
+// trailing * is kept as prefix search, all words are required
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		prefix := strings.HasSuffix(w, "*")
+		w = strings.TrimSpace(strings.Replace(strings.TrimRight(w, "*"), `"`, " ", -1)) // quote is separator for tokenizer anyway
+		if w == "" {
+			continue
+		}
+		if prefix {
+			w += "*"
+		}
+		terms = append(terms, `"`+w+`"`)
+	}
+	return strings.Join(terms, " ")
+}
+
+// bm25 ranks row by matchinfo(..., 'pcnalx') like fts5 bm25() does, but the more the better
+func bm25(matchinfo []byte) float64 {
+	const k1, b = 1.2, 0.75
+	v := make([]float64, len(matchinfo)/4)
+	for i := range v {
+		v[i] = float64(binary.NativeEndian.Uint32(matchinfo[i*4:])) // matchinfo is array of native uint32
+	}
+	phrases, columns, rows := int(v[0]), int(v[1]), v[2]
+	avgLength, length, hits := v[3:3+columns], v[3+columns:3+2*columns], v[3+2*columns:]
+	score := 0.
+	for i := 0; i < phrases; i++ {
+		for j := 0; j < columns; j++ {
+			x := hits[3*(i*columns+j):]
+			tf, docs := x[0], x[2]
+			idf := math.Max(math.Log((rows-docs+0.5)/(docs+0.5)), 1e-6)
+			norm := 1 - b + b*length[j]/math.Max(avgLength[j], 1)
+			score += idf * tf * (k1 + 1) / (tf + k1*norm)
+		}
+	}
+	return score
+}
+
+// highlight wraps matched terms of text, offsets are offsets() of fts4: column, term, byte offset, byte size
+func highlight(text string, offsets string, open string, close string) string {
+	f := strings.Fields(offsets)
+	type match struct{ start, end int }
+	var matches []match
+	for i := 0; i+3 < len(f); i += 4 {
+		start, _ := strconv.Atoi(f[i+2])
+		size, _ := strconv.Atoi(f[i+3])
+		if start+size <= len(text) {
+			matches = append(matches, match{start, start + size})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].start < matches[j].start })
+	var r strings.Builder
+	pos := 0
+	for _, m := range matches {
+		if m.start < pos {
+			continue // the same token matched by two phrases
+		}
+		r.WriteString(text[pos:m.start] + open + text[m.start:m.end] + close)
+		pos = m.end
+	}
+	r.WriteString(text[pos:])
+	return r.String()
+}
+
+func SearchRides(ctx context.Context, query string, first int, after *string) (*RideSearchConnection, error) {
+	if first < 0 {
+		return nil, ValidationError("Argument first must be non-negative").WithDetail("argument", "first")
+	}
+	offset := 0
+	if after != nil {
+		o, err := cursorToOffset(*after)
+		if err != nil {
+			return nil, err
+		}
+		offset = o + 1
+	}
+	connection := &RideSearchConnection{Edges: []*RideSearchEdge{}, PageInfo: &PageInfo{}}
+	q := ftsQuery(query)
+	if q == "" || first == 0 {
+		return connection, nil
+	}
+	res := sql(
+		ctx,
+		"select docid ride_id, destination,"+
+			" snippet(RideSearch, '<b>', '</b>', '...', 0, 8) snippet,"+
+			" offsets(RideSearch) offsets,"+
+			" matchinfo(RideSearch, 'pcnalx') matchinfo"+
+			" from RideSearch where RideSearch match ? order by docid",
+		q,
+	)
+	edges := make([]*RideSearchEdge, len(res))
+	for i, e := range res {
+		edges[i] = &RideSearchEdge{
+			Node:      NewRide(int(e["ride_id"].(int64))),
+			Snippet:   e["snippet"].(string),
+			Highlight: highlight(e["destination"].(string), e["offsets"].(string), "<b>", "</b>"),
+			Score:     bm25(e["matchinfo"].([]byte)),
+		}
+	}
+	sort.SliceStable(edges, func(i, j int) bool { return edges[i].Score > edges[j].Score }) // ties keep ride order
+	if offset > len(edges) {
+		offset = len(edges)
+	}
+	edges = edges[offset:]
+	if len(edges) > first {
+		edges = edges[:first]
+		connection.PageInfo.HasNextPage = true
+	}
+	for i, e := range edges {
+		e.Cursor = offsetToCursor(offset + i)
+	}
+	connection.Edges = edges
+	if len(connection.Edges) > 0 {
+		connection.PageInfo.EndCursor = &connection.Edges[len(connection.Edges)-1].Cursor
+	}
+	return connection, nil
 }
 
 // ----- loaders -----
@@ -295,26 +840,23 @@ func keysToString(keys dataloader.Keys) string {
 	return strings.Join(keysString, ", ")
 }
 
-func loadOneToOne(sqlTemplate string, keyField string, keys dataloader.Keys) []*dataloader.Result {
+func loadOneToOne(ctx context.Context, sqlTemplate string, keyField string, keys dataloader.Keys) []*dataloader.Result {
 	var results []*dataloader.Result
-	res := sql(fmt.Sprintf(sqlTemplate, keysToString(keys))) // Oh. Invalid request if empty list
+	res := sql(ctx, fmt.Sprintf(sqlTemplate, keysToString(keys))) // Oh. Invalid request if empty list
 	data := map[int]sqlite3.RowMap{}
 	for _, e := range res {
 		data[int(e[keyField].(int64))] = e
 	}
 	for _, e := range keys {
 		d := data[e.Raw().(int)]
-		results = append(results, &dataloader.Result{d, nil}) // TODO we can put errors here
+		results = append(results, &dataloader.Result{Data: d, Error: nil}) // TODO we can put errors here
 	}
 	return results
 }
 
-func loadOneToMany(sqlTemplate string, keyField string, keys dataloader.Keys) []*dataloader.Result {
+func loadOneToMany(ctx context.Context, sqlTemplate string, keyField string, keys dataloader.Keys) []*dataloader.Result {
 	var results []*dataloader.Result
-	res := sql(fmt.Sprintf(sqlTemplate, keysToString(keys))) // Oh. Invalid request if empty list
-	if len(res) == 0 {
-		return nil
-	}
+	res := sql(ctx, fmt.Sprintf(sqlTemplate, keysToString(keys))) // Oh. Invalid request if empty list
 	data := map[int][]sqlite3.RowMap{}
 	for _, e := range res {
 		i := int(e[keyField].(int64))
@@ -322,55 +864,239 @@ func loadOneToMany(sqlTemplate string, keyField string, keys dataloader.Keys) []
 	}
 	for _, e := range keys {
 		d := data[e.Raw().(int)]
-		results = append(results, &dataloader.Result{d, nil}) // TODO we can put errors here
+		results = append(results, &dataloader.Result{Data: d, Error: nil}) // TODO we can put errors here
 	}
 	return results
 }
 
-func NewLoaders() map[string](*dataloader.Loader) {
-	// we can do here all per-request stuff
-	fmt.Println("\x1b[1;34mLoaders created\x1b[0m")
-	return map[string]*dataloader.Loader{
-		"driver": dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
-			return loadOneToOne("select * from Driver where driver_id in (%s)", "driver_id", keys)
-		}),
-		"customer": dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
-			return loadOneToOne("select * from Customer where customer_id in (%s)", "customer_id", keys)
-		}),
-		"ride": dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
-			return loadOneToOne("select * from Ride where ride_id in (%s)", "ride_id", keys)
-		}),
-		"rides_by_driver_id": dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
-			return loadOneToMany("select * from Ride where driver_id in (%s)", "driver_id", keys)
-		}),
-		"rides_by_customer_id": dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
-			return loadOneToMany("select * from Ride where customer_id in (%s)", "customer_id", keys)
-		}),
-		"deep_rides_by_customer_id": dataloader.NewBatchedLoader(func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
-			return loadOneToMany("select * from Ride join Driver using (driver_id) where customer_id in (%s)", "customer_id", keys)
-		}),
+// batchFunctions are shared by all loaders sets, see NewLoaders
+var batchFunctions = map[string]dataloader.BatchFunc{
+	"driver": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToOne(ctx, "select * from Driver where driver_id in (%s)", "driver_id", keys)
+	},
+	"customer": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToOne(ctx, "select * from Customer where customer_id in (%s)", "customer_id", keys)
+	},
+	"ride": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToOne(ctx, "select * from Ride where ride_id in (%s)", "ride_id", keys)
+	},
+	"rides_by_driver_id": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToMany(ctx, "select * from Ride where driver_id in (%s)", "driver_id", keys)
+	},
+	"rides_by_customer_id": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToMany(ctx, "select * from Ride where customer_id in (%s)", "customer_id", keys)
+	},
+	"deep_rides_by_customer_id": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToMany(ctx, "select * from Ride join Driver using (driver_id) where customer_id in (%s)", "customer_id", keys)
+	},
+	"vehicle": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToOne(ctx, "select * from Vehicle where vehicle_id in (%s)", "vehicle_id", keys)
+	},
+	"vehicles_by_driver_id": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToMany(ctx, "select * from Vehicle where driver_id in (%s) order by vehicle_id", "driver_id", keys)
+	},
+	// aggregates: keys without rides get nil row, see callTrunkGetCount
+	"rides_count_by_driver_id": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToOne(ctx, "select driver_id, count(*) rides_count from Ride where driver_id in (%s) group by driver_id", "driver_id", keys)
+	},
+	"rides_count_by_customer_id": func(ctx context.Context, keys dataloader.Keys) []*dataloader.Result {
+		return loadOneToOne(ctx, "select customer_id, count(*) rides_count from Ride where customer_id in (%s) group by customer_id", "customer_id", keys)
+	},
+}
+
+func NewLoaders(opts ...dataloader.Option) map[string](*dataloader.Loader) {
+	// we can do here all per-request stuff; opts are applied to every loader (and can replace cache)
+	slog.Debug("loaders created")
+	loaders := make(map[string]*dataloader.Loader, len(batchFunctions))
+	for name, fn := range batchFunctions {
+		cache := dataloader.WithCache(newMetricsCache(name, dataloader.NewCache()))
+		loaders[name] = dataloader.NewBatchedLoader(instrumentBatch(name, recoveringBatch(name, fn)), append([]dataloader.Option{cache}, opts...)...)
 	}
+	return loaders
 }
 
 // ----- m.a.i.n -----
 
 func main() {
-	var driverType = graphql.NewObject(graphql.ObjectConfig{
-		Name: "Driver", // used by graphlql-relay
+	args := os.Args[1:]
+	printConfig := len(args) >= 2 && args[0] == "config" && args[1] == "print"
+	if printConfig {
+		args = args[2:]
+	}
+	c, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	config = c
+	if printConfig {
+		if err := config.print(os.Stdout); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	if err := setupLogging(config.Log); err != nil {
+		panic(err)
+	}
+	if err := setupAuth(config.Auth); err != nil {
+		panic(err)
+	}
+	if err := setupHTTPCache(config.HTTPCache); err != nil {
+		panic(err)
+	}
+
+	production = config.Env == "production"
+	documents = newDocumentCache(config.DocumentCache)
+	if path := config.Persisted.Manifest; path != "" {
+		if err := loadPersistedQueryManifest(path); err != nil {
+			panic(err)
+		}
+	}
+
+	migrate()
+	schema, err := newSchema()
+	if err != nil {
+		panic(err)
+	}
+	schemaVersion = schemaHash(schema)
+	instruments = append(instruments, tracingInstrument)
+	shutdownTelemetry, err := setupTelemetry(config.Telemetry.TracesExporter)
+	if err != nil {
+		panic(err)
+	}
+	setupMetrics()
+	setupHealth()
+	streamResolvers(&schema)
+	instrumentResolvers(&schema)
+
+	handler := handlerWrapper(handler.New(&handler.Config{
+		Schema:     &schema,
+		Pretty:     true,
+		GraphiQL:   config.GraphiQL,
+		Playground: config.Playground,
+	}), &schema)
+	http.Handle("/gql", handler)
+
+	fmt.Println(`
+Examples:
+  query { x_ride(id:2) {id destination customer {id name} driver {id name}} }
+  query { x_customer(id: 200) {id name, rides {id, destination, driver {name}}} }
+  query { x_ride(id: 3) {id destination customer {id name rides {id driver {name}}}} }
+  query { x_ride(id: 3) {id destination customer {id name rides {id driver {name rides {id}}}}} }
+  query { x_customer(id: 200) {rides{ driver{rides{ driver{rides{ driver{name} }} }} }} }
+  query { x_rides(ids:[1 2]){id destination} }
+  mutation { add_ride(params:{customer_id:100 driver_id:1 destination:"One"}){id, customer{name}} }
+  query { x_customer(id: 200) {deep_rides{ driver{name} }} }
+  query { x_customer(id: 200) {rides{ driver{name} }} }
+  query { x_rides(ids:[1 2 3]){id vehicle{plate class} driver{name vehicles{plate retired}}} }
+  mutation { register_vehicle(params:{driver_id:2 plate:"B002BB" make:"VW" model:"Polo" seats:4 class:ECONOMY}){id driver{name}} }
+  mutation { add_ride(params:{customer_id:100 driver_id:1 destination:"Two" vehicle_id:10}){id vehicle{plate}} }
+  mutation { retire_vehicle(id:11){id retired} }
+  query { x_rides(ids:[1 2 3]){driver{name ridesCount} customer{name ridesCount}} }
+  query { search(text:"_2"){__typename ...on Person{id name} ...on Ride{id destination}} }
+  query { searchRides(query:"addr*" first:2){edges{cursor score snippet node{id customer{name}}} pageInfo{hasNextPage endCursor}} }
+  query { stats{totalRides topDestinations(limit:2){destination ridesCount} busiestDrivers(limit:1){name ridesCount}} }
+  mutation { set_ride_status(id:2 status:ACCEPTED){id status} }
+Incremental delivery (Accept: multipart/mixed):
+  query { x_customer(id: 200) {name ... @defer(label: "slow") {rides {driver {rides {destination}}}}} }
+  query { x_customer(id: 200) {name rides @stream(initialCount: 1) {id destination}} }
+Subscriptions (graphql-transport-ws over ws://localhost:8080/gql):
+  subscription { rideAdded(driverId:1) {id destination customer{name}} }
+  subscription { rideStatusChanged(rideId:2) {id status} }
+Subscriptions (graphql-sse, distinct connections mode):
+  curl -N http://localhost:8080/gql -H 'Accept: text/event-stream' -H 'Content-Type: application/graphql' -d 'subscription { rideStatusChanged {id status} }'
+Curl:
+  curl -XPOST http://localhost:8080/gql -H 'Content-Type: application/graphql' -d "$QUERY"
+GraphiQL (in browser):
+  http://localhost:8080/gql`)
+	err = runServer(newServer(http.DefaultServeMux))
+	shutdownTelemetry(context.Background()) // flush spans
+	if err != nil {
+		slog.Error("server failed", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("server stopped")
+}
+
+// newSchema builds schema of the service, resolvers are not instrumented yet
+func newSchema() (graphql.Schema, error) {
+	// Person is defined ahead of its implementations, they are assigned below
+	var driverType, customerType *graphql.Object
+
+	var personType = graphql.NewInterface(graphql.InterfaceConfig{
+		Name: "Person",
+		Fields: graphql.Fields{
+			"id":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+		ResolveType: func(p graphql.ResolveTypeParams) *graphql.Object {
+			switch p.Value.(type) {
+			case *Driver:
+				return driverType
+			case *Customer:
+				return customerType
+			}
+			return nil
+		},
+	})
+
+	driverType = graphql.NewObject(graphql.ObjectConfig{
+		Name:       "Driver", // used by graphlql-relay
+		Interfaces: []*graphql.Interface{personType},
 		Fields: graphql.Fields{
 			"id":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
 			"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 		},
 	})
 
-	var customerType = graphql.NewObject(graphql.ObjectConfig{
-		Name: "Customer",
+	customerType = graphql.NewObject(graphql.ObjectConfig{
+		Name:       "Customer",
+		Interfaces: []*graphql.Interface{personType},
 		Fields: graphql.Fields{
 			"id":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
 			"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
 		},
 	})
 
+	var vehicleClassType = graphql.NewEnum(graphql.EnumConfig{
+		Name: "VehicleClass",
+		Values: graphql.EnumValueConfigMap{
+			"ECONOMY":  &graphql.EnumValueConfig{Value: "economy"},
+			"COMFORT":  &graphql.EnumValueConfig{Value: "comfort"},
+			"BUSINESS": &graphql.EnumValueConfig{Value: "business"},
+			"VAN":      &graphql.EnumValueConfig{Value: "van"},
+		},
+	})
+
+	var vehicleType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Vehicle",
+		Fields: graphql.Fields{
+			"id":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"driver":  &graphql.Field{Type: graphql.NewNonNull(driverType)},
+			"plate":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"make":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"model":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"seats":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"class":   &graphql.Field{Type: graphql.NewNonNull(vehicleClassType)},
+			"retired": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+		},
+	})
+
+	var rideStatusType = graphql.NewEnum(graphql.EnumConfig{
+		Name: "RideStatus",
+		Values: graphql.EnumValueConfigMap{
+			"REQUESTED":   &graphql.EnumValueConfig{Value: "requested"},
+			"ACCEPTED":    &graphql.EnumValueConfig{Value: "accepted"},
+			"IN_PROGRESS": &graphql.EnumValueConfig{Value: "in_progress"},
+			"COMPLETED":   &graphql.EnumValueConfig{Value: "completed"},
+			"CANCELLED":   &graphql.EnumValueConfig{Value: "cancelled"},
+		},
+	})
+
 	var rideType = graphql.NewObject(graphql.ObjectConfig{
 		Name: "Ride",
 		Fields: graphql.Fields{
@@ -378,12 +1104,88 @@ func main() {
 			"driver":      &graphql.Field{Type: graphql.NewNonNull(driverType)},
 			"customer":    &graphql.Field{Type: graphql.NewNonNull(customerType)},
 			"destination": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"vehicle":     &graphql.Field{Type: vehicleType},
+			"status":      &graphql.Field{Type: graphql.NewNonNull(rideStatusType)},
+		},
+	})
+
+	var destinationStatType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "DestinationStat",
+		Fields: graphql.Fields{
+			"destination": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"ridesCount":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	var statsType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "Stats",
+		Fields: graphql.Fields{
+			"totalRides": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"topDestinations": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(destinationStatType))),
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10},
+				},
+			},
+			"busiestDrivers": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(driverType))),
+				Args: graphql.FieldConfigArgument{
+					"limit": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10},
+				},
+			},
 		},
 	})
 
+	personType.AddFieldConfig("rides", &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(rideType)))})
 	customerType.AddFieldConfig("rides", &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(rideType)))})
 	customerType.AddFieldConfig("deep_rides", &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(rideType)))})
 	driverType.AddFieldConfig("rides", &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(rideType)))})
+	driverType.AddFieldConfig("vehicles", &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(vehicleType)))})
+	driverType.AddFieldConfig("ridesCount", &graphql.Field{Type: graphql.NewNonNull(graphql.Int)})
+	customerType.AddFieldConfig("ridesCount", &graphql.Field{Type: graphql.NewNonNull(graphql.Int)})
+
+	searchResultType := graphql.NewUnion(graphql.UnionConfig{
+		Name:  "SearchResult",
+		Types: []*graphql.Object{driverType, customerType, rideType},
+		ResolveType: func(p graphql.ResolveTypeParams) *graphql.Object {
+			switch p.Value.(type) {
+			case *Driver:
+				return driverType
+			case *Customer:
+				return customerType
+			case *Ride, *CompleteRide:
+				return rideType
+			}
+			return nil
+		},
+	})
+
+	var pageInfoType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"endCursor":   &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	var rideSearchEdgeType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "RideSearchEdge",
+		Fields: graphql.Fields{
+			"cursor":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"node":      &graphql.Field{Type: graphql.NewNonNull(rideType)},
+			"snippet":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"highlight": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"score":     &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+		},
+	})
+
+	var rideSearchConnectionType = graphql.NewObject(graphql.ObjectConfig{
+		Name: "RideSearchConnection",
+		Fields: graphql.Fields{
+			"edges":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(rideSearchEdgeType)))},
+			"pageInfo": &graphql.Field{Type: graphql.NewNonNull(pageInfoType)},
+		},
+	})
 
 	queryType := graphql.NewObject(graphql.ObjectConfig{
 		Name: "Query",
@@ -395,8 +1197,12 @@ func main() {
 					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
 				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					principal, err := restrictedPrincipal(p.Context)
+					if err != nil {
+						return nil, err
+					}
 					rideId := p.Args["id"].(int)
-					return NewRide(rideId), nil // in fact, we have to check is rideId exists in db
+					return readableRide(p, principal, NewRide(rideId)), nil // in fact, we have to check is rideId exists in db
 				},
 			},
 			"x_rides": &graphql.Field{
@@ -406,10 +1212,14 @@ func main() {
 					"ids": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.Int)))},
 				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					principal, err := restrictedPrincipal(p.Context)
+					if err != nil {
+						return nil, err
+					}
 					rideIds := p.Args["ids"].([]interface{})
-					rides := make([]*Ride, len(rideIds))
+					rides := make([]interface{}, len(rideIds)) // foreign rides are nulls with errors
 					for i, e := range rideIds {
-						rides[i] = NewRide(e.(int))
+						rides[i] = readableRide(p, principal, NewRide(e.(int)))
 					}
 					return rides, nil
 				},
@@ -421,9 +1231,51 @@ func main() {
 				},
 				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
 					customerId := p.Args["id"].(int)
+					if err := requireSelf(p.Context, RoleCustomer, customerId); err != nil {
+						return nil, err
+					}
 					return NewCustomer(customerId), nil
 				},
 			},
+			"search": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(searchResultType)),
+				Args: graphql.FieldConfigArgument{
+					"text": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if _, err := requireRole(p.Context, RoleDispatcher, RoleAdmin); err != nil {
+						return nil, err
+					}
+					return Search(p, p.Args["text"].(string)), nil
+				},
+			},
+			"searchRides": &graphql.Field{
+				Type: graphql.NewNonNull(rideSearchConnectionType),
+				Args: graphql.FieldConfigArgument{
+					"query": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"first": &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 10},
+					"after": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if _, err := requireRole(p.Context, RoleDispatcher, RoleAdmin); err != nil {
+						return nil, err
+					}
+					var after *string
+					if a, ok := p.Args["after"].(string); ok {
+						after = &a
+					}
+					return SearchRides(p.Context, p.Args["query"].(string), p.Args["first"].(int), after)
+				},
+			},
+			"stats": &graphql.Field{
+				Type: graphql.NewNonNull(statsType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					if _, err := requireRole(p.Context, RoleDispatcher, RoleAdmin); err != nil {
+						return nil, err // aggregates over rides of all customers
+					}
+					return &Stats{}, nil
+				},
+			},
 		},
 	})
 
@@ -439,6 +1291,33 @@ func main() {
 			"destination": &graphql.InputObjectFieldConfig{
 				Type: graphql.NewNonNull(graphql.String),
 			},
+			"vehicle_id": &graphql.InputObjectFieldConfig{
+				Type: graphql.Int, // optional; vehicle must be owned by driver
+			},
+		},
+	})
+
+	vehicleInputType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "VehicleInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"driver_id": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.Int),
+			},
+			"plate": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"make": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"model": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.String),
+			},
+			"seats": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(graphql.Int),
+			},
+			"class": &graphql.InputObjectFieldConfig{
+				Type: graphql.NewNonNull(vehicleClassType),
+			},
 		},
 	})
 
@@ -456,62 +1335,191 @@ func main() {
 					customerId := params["customer_id"].(int)
 					driverId := params["driver_id"].(int)
 					destination := params["destination"].(string)
+					principal, err := requireRole(p.Context, RoleCustomer, RoleDispatcher, RoleAdmin)
+					if err != nil {
+						return nil, err
+					}
+					if err := ownUser(principal, RoleCustomer, customerId); err != nil {
+						return nil, err
+					}
+					var vehicleId interface{} // NULL if not set
+					if id, ok := params["vehicle_id"].(int); ok {
+						if err := checkVehicleForRide(p.Context, id, driverId); err != nil {
+							return nil, err
+						}
+						vehicleId = id
+					}
 					// Oh. Just POC. Very (very!) bad code.
 					// We just use sqlite backend to emulate abstract microservice or something else
-					res := sql("select max(ride_id) max_ride_id from Ride")
+					res := sql(p.Context, "select max(ride_id) max_ride_id from Ride")
 					nextRideId := int(res[0]["max_ride_id"].(int64)) + 1
-					res = sql(fmt.Sprintf(
-						"insert into Ride (ride_id, customer_id, driver_id, destination) values (%d, %d, %d, \"%s\")",
+					res = sql(
+						p.Context,
+						"insert into Ride (ride_id, customer_id, driver_id, destination, vehicle_id) values (?, ?, ?, ?, ?)",
 						nextRideId,
 						customerId,
 						driverId,
 						destination,
-					))
-					res = sql(fmt.Sprintf(
+						vehicleId,
+					)
+					res = sql(p.Context, fmt.Sprintf(
 						"select * from Ride where ride_id=%d",
 						nextRideId,
 					))
-					return &CompleteRide{
-						Id:          nextRideId,
-						Driver:      NewDriver(driverId),
-						Customer:    NewCustomer(customerId),
-						Destination: destination,
-					}, nil
+					ride := NewCompleteRide(res[0])
+					rideEvents.Publish(Event{Topic: TopicRideAdded, Ride: ride})
+					return ride, nil
+				},
+			},
+			"set_ride_status": &graphql.Field{
+				Name: "set_ride_status",
+				Type: rideType,
+				Args: graphql.FieldConfigArgument{
+					"id":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"status": &graphql.ArgumentConfig{Type: graphql.NewNonNull(rideStatusType)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					rideId := p.Args["id"].(int)
+					status := p.Args["status"].(string)
+					principal, err := requireRole(p.Context, RoleDriver, RoleDispatcher, RoleAdmin)
+					if err != nil {
+						return nil, err
+					}
+					res := sql(p.Context, "select * from Ride where ride_id=?", rideId)
+					if len(res) == 0 {
+						return nil, NotFoundError("Ride %d not found", rideId).WithDetail("ride_id", rideId)
+					}
+					if err := ownUser(principal, RoleDriver, int(res[0]["driver_id"].(int64))); err != nil {
+						return nil, err
+					}
+					if res[0]["status"].(string) == status {
+						return NewCompleteRide(res[0]), nil // nothing changed, nothing to publish
+					}
+					sql(p.Context, "update Ride set status=? where ride_id=?", status, rideId)
+					res = sql(p.Context, "select * from Ride where ride_id=?", rideId)
+					ride := NewCompleteRide(res[0])
+					rideEvents.Publish(Event{Topic: TopicRideStatusChanged, Ride: ride})
+					return ride, nil
+				},
+			},
+			"register_vehicle": &graphql.Field{
+				Name: "register_vehicle",
+				Type: vehicleType,
+				Args: graphql.FieldConfigArgument{
+					"params": &graphql.ArgumentConfig{Type: graphql.NewNonNull(vehicleInputType)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					params := p.Args["params"].(map[string]interface{})
+					driverId := params["driver_id"].(int)
+					plate := params["plate"].(string)
+					if _, err := requireRole(p.Context, RoleDispatcher, RoleAdmin); err != nil {
+						return nil, err
+					}
+					if len(sql(p.Context, "select driver_id from Driver where driver_id=?", driverId)) == 0 {
+						return nil, NotFoundError("Driver %d not found", driverId).WithDetail("driver_id", driverId)
+					}
+					if len(sql(p.Context, "select vehicle_id from Vehicle where plate=?", plate)) != 0 {
+						return nil, ConflictError("Vehicle with plate %s already registered", plate).WithDetail("plate", plate)
+					}
+					sql(
+						p.Context,
+						"insert into Vehicle (driver_id, plate, make, model, seats, class, retired) values (?, ?, ?, ?, ?, ?, 0)",
+						driverId,
+						plate,
+						params["make"].(string),
+						params["model"].(string),
+						params["seats"].(int),
+						params["class"].(string),
+					)
+					res := sql(p.Context, "select * from Vehicle where plate=?", plate)
+					return NewCompleteVehicle(res[0]), nil
+				},
+			},
+			"retire_vehicle": &graphql.Field{
+				Name: "retire_vehicle",
+				Type: vehicleType,
+				Args: graphql.FieldConfigArgument{
+					"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					vehicleId := p.Args["id"].(int)
+					if _, err := requireRole(p.Context, RoleDispatcher, RoleAdmin); err != nil {
+						return nil, err
+					}
+					sql(p.Context, "update Vehicle set retired=1 where vehicle_id=?", vehicleId)
+					res := sql(p.Context, "select * from Vehicle where vehicle_id=?", vehicleId)
+					if len(res) == 0 {
+						return nil, NotFoundError("Vehicle %d not found", vehicleId).WithDetail("vehicle_id", vehicleId)
+					}
+					return NewCompleteVehicle(res[0]), nil
 				},
 			},
 		},
 	})
 
-	var schema, err = graphql.NewSchema(graphql.SchemaConfig{
-		Query:    queryType,
-		Mutation: mutationType,
+	subscriptionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"rideAdded": &graphql.Field{
+				Type: graphql.NewNonNull(rideType),
+				Args: graphql.FieldConfigArgument{
+					"driverId":   &graphql.ArgumentConfig{Type: graphql.Int},
+					"customerId": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+					principal, err := restrictedPrincipal(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					driverId, byDriver := p.Args["driverId"].(int)
+					customerId, byCustomer := p.Args["customerId"].(int)
+					if byDriver {
+						if err := ownUser(principal, RoleDriver, driverId); err != nil {
+							return nil, err
+						}
+					}
+					if byCustomer {
+						if err := ownUser(principal, RoleCustomer, customerId); err != nil {
+							return nil, err
+						}
+					}
+					return subscribeRides(p.Context, TopicRideAdded, func(e Event) bool {
+						return (!byDriver || e.Ride.Driver.id == driverId) && (!byCustomer || e.Ride.Customer.id == customerId) &&
+							canReadRide(principal, e.Ride.Customer.id, e.Ride.Driver.id)
+					}), nil
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source, nil // event from subscribeRides
+				},
+			},
+			"rideStatusChanged": &graphql.Field{
+				Type: graphql.NewNonNull(rideType),
+				Args: graphql.FieldConfigArgument{
+					"rideId": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+					principal, err := restrictedPrincipal(p.Context)
+					if err != nil {
+						return nil, err
+					}
+					rideId, byRide := p.Args["rideId"].(int)
+					return subscribeRides(p.Context, TopicRideStatusChanged, func(e Event) bool {
+						return (!byRide || e.Ride.Id == rideId) && canReadRide(principal, e.Ride.Customer.id, e.Ride.Driver.id)
+					}), nil
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return p.Source, nil
+				},
+			},
+		},
 	})
-	if err != nil {
-		panic(err)
-	}
 
-	handler := handlerWrapper(handler.New(&handler.Config{
-		Schema:     &schema,
-		Pretty:     true,
-		GraphiQL:   true,
-		Playground: true,
-	}))
-	http.Handle("/gql", handler)
-
-	fmt.Println(`
-Examples:
-  query { x_ride(id:2) {id destination customer {id name} driver {id name}} }
-  query { x_customer(id: 200) {id name, rides {id, destination, driver {name}}} }
-  query { x_ride(id: 3) {id destination customer {id name rides {id driver {name}}}} }
-  query { x_ride(id: 3) {id destination customer {id name rides {id driver {name rides {id}}}}} }
-  query { x_customer(id: 200) {rides{ driver{rides{ driver{rides{ driver{name} }} }} }} }
-  query { x_rides(ids:[1 2]){id destination} }
-  mutation { add_ride(params:{customer_id:100 driver_id:1 destination:"One"}){id, customer{name}} }
-  query { x_customer(id: 200) {deep_rides{ driver{name} }} }
-  query { x_customer(id: 200) {rides{ driver{name} }} }
-Curl:
-  curl -XPOST http://localhost:8080/gql -H 'Content-Type: application/graphql' -d "$QUERY"
-GraphiQL (in browser):
-  http://localhost:8080/gql`)
-	http.ListenAndServe(":8080", nil)
+	schemaExtensions = []graphql.Extension{errorsExtension{}, tracingExtension{}, telemetryExtension{}, metricsExtension{}, loggingExtension{}, requestIdExtension{}}
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query:        queryType,
+		Mutation:     mutationType,
+		Subscription: subscriptionType,
+		Directives:   append(append([]*graphql.Directive{}, graphql.SpecifiedDirectives...), deferDirective, streamDirective),
+		Extensions:   schemaExtensions,
+	})
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql"
+)
+
+// serviceSchema is schema of the service over testDatabase
+func serviceSchema(t testing.TB) *graphql.Schema {
+	t.Helper()
+	testDatabase(t)
+	migrate()
+	schema, err := newSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &schema
+}
+
+// execute runs query as principal, result is returned as json
+func execute(schema *graphql.Schema, principal *Principal, query string) string {
+	ctx := context.WithValue(withPrincipal(context.Background(), principal), "dataloaders", NewLoaders())
+	b, _ := json.Marshal(executeQuery(graphql.Params{Schema: *schema, RequestString: query, Context: ctx}))
+	return string(b)
+}
+
+func TestStatsLimit(t *testing.T) {
+	schema := serviceSchema(t)
+	for _, c := range []struct{ query, want string }{
+		{"{ stats { topDestinations(limit: 1) { destination } } }", `{"data":{"stats":{"topDestinations":[{"destination":"Adderss_for_ride_1"}]}}}`},
+		{"{ stats { topDestinations(limit: -1) { destination } } }", `"code":"VALIDATION"`},
+		{"{ stats { busiestDrivers(limit: -1) { name } } }", `"code":"VALIDATION"`},
+		{"{ stats { busiestDrivers(limit: 0) { name } } }", `{"data":{"stats":{"busiestDrivers":[]}}}`},
+	} {
+		if got := execute(schema, nil, c.query); !strings.Contains(got, c.want) {
+			t.Errorf("%s: %s, want %s", c.query, got, c.want)
+		}
+	}
+}
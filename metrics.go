@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/graph-gophers/dataloader"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ----- prometheus metrics -----
+
+// Request metrics cover request-response operations only (plain and multipart);
+// subscriptions over ws and sse are long-lived, their durations make no sense.
+// Cache hit ratio: rate(dataloader_cache_requests_total{result="hit"}) / rate(dataloader_cache_requests_total).
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_requests_total",
+		Help: "GraphQL requests by operation.",
+	}, []string{"operation_name", "operation_type"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "graphql_request_duration_seconds",
+		Help:    "GraphQL request latency by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation_name", "operation_type"})
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_errors_total",
+		Help: "GraphQL errors by extensions.code.",
+	}, []string{"code"})
+	resolverDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "graphql_resolver_duration_seconds",
+		Help:    "Resolver latency (thunk included) for hot fields.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"field"})
+	batchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dataloader_batch_size",
+		Help:    "Number of keys in dataloader batch.",
+		Buckets: []float64{1, 2, 5, 10, 20, 50, 100},
+	}, []string{"loader"})
+	cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "dataloader_cache_requests_total",
+		Help: "Dataloader cache lookups by result (hit or miss).",
+	}, []string{"loader", "result"})
+	documentCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "graphql_document_cache_requests_total",
+		Help: "Document cache lookups of executed operations by result (hit skips parsing and validation, or miss).",
+	}, []string{"result"})
+	sqlDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sql_query_duration_seconds",
+		Help:    "SQL statement latency by statement template.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	}, []string{"template"})
+)
+
+// openConnections is maintained by openDatabase/closeDatabase
+var openConnections int64
+
+// hotFields are worth to be measured; measuring every field is too costly and makes too many series
+var hotFields = map[string]bool{
+	"Query.x_ride":      true,
+	"Query.x_rides":     true,
+	"Query.x_customer":  true,
+	"Query.search":      true,
+	"Query.searchRides": true,
+	"Query.stats":       true,
+	"Ride.driver":       true,
+	"Ride.customer":     true,
+	"Ride.vehicle":      true,
+	"Driver.rides":      true,
+	"Driver.vehicles":   true,
+	"Customer.rides":    true,
+}
+
+func setupMetrics() {
+	prometheus.MustRegister(requestsTotal, requestDuration, errorsTotal, resolverDuration, batchSize, cacheRequests, documentCacheRequests, sqlDuration)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "db_open_connections",
+		Help: "Open database connections.",
+	}, func() float64 { return float64(atomic.LoadInt64(&openConnections)) }))
+	instruments = append(instruments, metricsInstrument)
+	http.Handle("/metrics", promhttp.Handler())
+}
+
+var metricsInstrument = Instrument{
+	Field: func(ctx context.Context, info graphql.ResolveInfo) (context.Context, func(error)) {
+		field := info.ParentType.Name() + "." + info.FieldName
+		if !hotFields[field] {
+			return ctx, func(error) {}
+		}
+		start := time.Now()
+		return ctx, func(error) {
+			resolverDuration.WithLabelValues(field).Observe(time.Since(start).Seconds())
+		}
+	},
+	Batch: func(ctx context.Context, loader string, size int) (context.Context, func()) {
+		batchSize.WithLabelValues(loader).Observe(float64(size))
+		return ctx, func() {}
+	},
+	SQL: func(ctx context.Context, query string) (context.Context, func(int, error)) {
+		template := sqlTemplate(query)
+		start := time.Now()
+		return ctx, func(int, error) {
+			sqlDuration.WithLabelValues(template).Observe(time.Since(start).Seconds())
+		}
+	},
+}
+
+// metricsCache counts hits and misses of loader cache
+type metricsCache struct {
+	dataloader.Cache
+	loader string
+}
+
+func newMetricsCache(loader string, cache dataloader.Cache) dataloader.Cache {
+	return &metricsCache{Cache: cache, loader: loader}
+}
+
+func (c *metricsCache) Get(ctx context.Context, key dataloader.Key) (dataloader.Thunk, bool) {
+	thunk, ok := c.Cache.Get(ctx, key)
+	if ok {
+		cacheRequests.WithLabelValues(c.loader, "hit").Inc()
+	} else {
+		cacheRequests.WithLabelValues(c.loader, "miss").Inc()
+	}
+	return thunk, ok
+}
+
+// ----- operation labels -----
+
+type operationLabelsKey struct{}
+
+// operationLabels are filled while request is being executed, see metricsExtension
+type operationLabels struct {
+	once          sync.Once
+	operationName string
+	operationType string
+}
+
+func setOperationLabels(ctx context.Context, operationName string, operationType string) {
+	if l, ok := ctx.Value(operationLabelsKey{}).(*operationLabels); ok {
+		l.once.Do(func() { // incremental delivery executes operation piece by piece
+			l.operationName = operationName
+			l.operationType = operationType
+		})
+	}
+}
+
+// withRequestMetrics calls next and measures it
+func withRequestMetrics(w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request)) {
+	l := &operationLabels{}
+	start := time.Now()
+	next(w, r.WithContext(context.WithValue(r.Context(), operationLabelsKey{}, l)))
+	requestsTotal.WithLabelValues(l.operationName, l.operationType).Inc()
+	requestDuration.WithLabelValues(l.operationName, l.operationType).Observe(time.Since(start).Seconds())
+}
+
+// errorCode takes code from error extensions, see classifyErrors
+func errorCode(err gqlerrors.FormattedError) string {
+	if code, ok := err.Extensions["code"].(string); ok {
+		return code
+	}
+	return string(CodeInternal)
+}
+
+// metricsExtension labels request with operation and counts errors
+type metricsExtension struct{}
+
+func (metricsExtension) Init(ctx context.Context, p *graphql.Params) context.Context {
+	t, _ := operationType(p.RequestString, p.OperationName) // unparsable request gets empty type
+	setOperationLabels(ctx, operationNameLabel(p.RequestString, p.OperationName), t)
+	return ctx
+}
+
+// operationNameLabel bounds number of series: clients can send any names (and register any apq documents),
+// so only names of documents from manifest are used, the rest are "other"
+func operationNameLabel(query string, operationName string) string {
+	if operationName == "" {
+		return ""
+	}
+	if !persisted.inManifest(queryHash(query)) {
+		return "other"
+	}
+	return operationName
+}
+
+func (metricsExtension) Name() string { return "metrics" }
+
+func (metricsExtension) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+	return ctx, func(err error) {
+		if err != nil {
+			errorsTotal.WithLabelValues(string(CodeGraphQLParseFailed)).Inc()
+		}
+	}
+}
+
+func (metricsExtension) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+	return ctx, func(errs []gqlerrors.FormattedError) {
+		if len(errs) > 0 {
+			errorsTotal.WithLabelValues(string(CodeGraphQLValidationFailed)).Add(float64(len(errs)))
+		}
+	}
+}
+
+func (metricsExtension) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+	return ctx, func(r *graphql.Result) {
+		for _, e := range r.Errors {
+			errorsTotal.WithLabelValues(errorCode(e)).Inc()
+		}
+	}
+}
+
+func (metricsExtension) ResolveFieldDidStart(ctx context.Context, i *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+	return ctx, func(interface{}, error) {} // see metricsInstrument
+}
+
+func (metricsExtension) HasResult() bool { return false }
+
+func (metricsExtension) GetResult(context.Context) interface{} { return nil }
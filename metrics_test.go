@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestOperationNameLabel(t *testing.T) {
+	known := "query Known {x_ride(id: 1) {id}}"
+	withAllowlist(t, known)
+	for _, c := range []struct {
+		query, name, want string
+	}{
+		{known, "Known", "Known"},
+		{"query Random123 {x_ride(id: 1) {id}}", "Random123", "other"},
+		{"{x_ride(id: 1) {id}}", "", ""},
+	} {
+		if got := operationNameLabel(c.query, c.name); got != c.want {
+			t.Errorf("operationNameLabel(%q, %q) = %q, want %q", c.query, c.name, got, c.want)
+		}
+	}
+}
+
+func TestOperationNameLabelOfRegisteredQuery(t *testing.T) {
+	prev := persisted
+	persisted = &persistedQueries{queries: map[string]string{}}
+	t.Cleanup(func() { persisted = prev })
+	query := "query Random123 {x_ride(id: 1) {id}}"
+	if _, err := persisted.resolve(query, map[string]interface{}{
+		"persistedQuery": map[string]interface{}{"version": 1.0, "sha256Hash": queryHash(query)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := persisted.get(queryHash(query)); !ok {
+		t.Fatal("query is not registered")
+	}
+	if got := operationNameLabel(query, "Random123"); got != "other" {
+		t.Errorf("label of apq registered by client %q, want other", got)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// ----- migrations -----
+
+// Base schema and demo data live in database_init.sh; migrations are applied over it on start.
+// Applied migrations are counted in PRAGMA user_version, so every migration is applied only once.
+// database_init.sh creates schema of migration 1 itself (it needs demo vehicles), so it sets user_version=1.
+// Never edit applied migration, add new one.
+
+var migrations = [][]string{
+	// 1: vehicles, see Vehicle type
+	{
+		`create table Vehicle (
+		   vehicle_id integer primary key autoincrement,
+		   driver_id integer references Driver,
+		   plate text unique,
+		   make text,
+		   model text,
+		   seats integer,
+		   class text,
+		   retired integer default 0)`,
+		"alter table Ride add column vehicle_id integer references Vehicle",
+	},
+	// 2: full-text search over Ride.destination; bundled sqlite (3.8.5) has fts4 only, no fts5
+	{
+		"create virtual table RideSearch using fts4(content='Ride', destination)",
+		"insert into RideSearch(RideSearch) values ('rebuild')",
+		// external content index has to drop old tokens before row changes, see sqlite fts4 docs
+		`create trigger Ride_search_bu before update of destination on Ride begin
+		   delete from RideSearch where docid = old.ride_id;
+		 end`,
+		`create trigger Ride_search_bd before delete on Ride begin
+		   delete from RideSearch where docid = old.ride_id;
+		 end`,
+		`create trigger Ride_search_au after update of destination on Ride begin
+		   insert into RideSearch(docid, destination) values (new.ride_id, new.destination);
+		 end`,
+		`create trigger Ride_search_ai after insert on Ride begin
+		   insert into RideSearch(docid, destination) values (new.ride_id, new.destination);
+		 end`,
+	},
+	// 3: ride status, see RideStatus enum
+	{
+		"alter table Ride add column status text not null default 'requested'",
+	},
+}
+
+// SchemaVersion is version of db we expect after migrate()
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+func dbVersion() int {
+	return int(sql(context.Background(), "PRAGMA user_version")[0]["user_version"].(int64))
+}
+
+func migrate() {
+	version := dbVersion()
+	for version < SchemaVersion() {
+		applyMigration(version+1, migrations[version])
+		version++
+	}
+}
+
+func applyMigration(version int, statements []string) {
+	c, err := openDatabase()
+	if err != nil {
+		panic(errorString("open", "migration", err))
+	}
+	defer closeDatabase(c)
+	if err := c.Begin(); err != nil {
+		panic(errorString("begin", "migration", err))
+	}
+	for _, s := range statements {
+		if err := c.Exec(s); err != nil {
+			c.Rollback()
+			panic(errorString(fmt.Sprintf("migration %d", version), s, err))
+		}
+	}
+	s := fmt.Sprintf("PRAGMA user_version = %d", version) // PRAGMA does not accept bound args
+	if err := c.Exec(s); err != nil {
+		c.Rollback()
+		panic(errorString(fmt.Sprintf("migration %d", version), s, err))
+	}
+	if err := c.Commit(); err != nil {
+		panic(errorString("commit", "migration", err))
+	}
+	slog.Info("migration applied", slog.Int("version", version))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mxk/go-sqlite/sqlite3"
+)
+
+// testDatabase points config to fresh in-memory database with schema of version 0 (before any migration);
+// the database lives while returned connection is open, it is closed on cleanup
+func testDatabase(t testing.TB) *sqlite3.Conn {
+	t.Helper()
+	prev := config.Database
+	config.Database = "file:" + strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()) + "?mode=memory&cache=shared"
+	c, err := sqlite3.Open(config.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		config.Database = prev
+	})
+	for _, s := range []string{
+		"create table Driver (driver_id integer primary key autoincrement, name string)",
+		"create table Customer (customer_id integer primary key autoincrement, name string)",
+		"create table Ride (ride_id integer primary key autoincrement, driver_id integer references Driver, customer_id integer references Customer, destination string)",
+		"insert into Driver values (1, 'Driver_1')",
+		"insert into Customer values (100, 'Customer_100')",
+		"insert into Ride values (1, 1, 100, 'Adderss_for_ride_1')",
+		"insert into Ride values (2, 1, 100, 'Address_for_ride_2')",
+		"insert into Ride values (3, 1, 100, 'Airport, terminal 2, address of airport')",
+	} {
+		if err := c.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	return c
+}
+
+func TestMigrateFreshDatabase(t *testing.T) {
+	testDatabase(t)
+	migrate()
+	if v := dbVersion(); v != SchemaVersion() {
+		t.Fatalf("version %d, want %d", v, SchemaVersion())
+	}
+	migrate() // nothing to apply
+
+	ctx := context.Background()
+	sql(ctx, "insert into Vehicle (vehicle_id, driver_id, plate, make, model, seats, class) values (10, 1, 'A001AA', 'Skoda', 'Octavia', 4, 'comfort')")
+	sql(ctx, "update Ride set vehicle_id = 10 where ride_id = 1")
+	row := sql(ctx, "select vehicle_id, status from Ride where ride_id = 1")[0]
+	if row["vehicle_id"] != int64(10) || row["status"] != "requested" {
+		t.Errorf("ride %v", row)
+	}
+}
+
+func TestRideSearchIndex(t *testing.T) {
+	testDatabase(t)
+	migrate()
+	ctx := context.Background()
+	search := func(q string) []int {
+		var ids []int
+		for _, e := range sql(ctx, "select docid from RideSearch where RideSearch match ? order by docid", ftsQuery(q)) {
+			ids = append(ids, int(e["docid"].(int64)))
+		}
+		return ids
+	}
+	if got := search("address"); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Errorf("rebuilt index: %v", got)
+	}
+	sql(ctx, "insert into Ride (ride_id, driver_id, customer_id, destination) values (4, 1, 100, 'Address_for_ride_4')")
+	sql(ctx, "update Ride set destination = 'Station' where ride_id = 2")
+	sql(ctx, "delete from Ride where ride_id = 3")
+	if got := search("address"); len(got) != 1 || got[0] != 4 {
+		t.Errorf("index after insert, update and delete: %v", got)
+	}
+	if got := search("station"); len(got) != 1 || got[0] != 2 {
+		t.Errorf("updated row: %v", got)
+	}
+}
+
+func TestSearchRides(t *testing.T) {
+	testDatabase(t)
+	migrate()
+	ctx := context.Background()
+
+	c, err := SearchRides(ctx, "a*", 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Edges) != 2 || !c.PageInfo.HasNextPage {
+		t.Fatalf("page %d edges, hasNextPage %v", len(c.Edges), c.PageInfo.HasNextPage)
+	}
+	for _, e := range c.Edges {
+		if e.Score <= 0 || !strings.Contains(e.Snippet, "<b>") || !strings.Contains(e.Highlight, "<b>") {
+			t.Errorf("edge %+v", e)
+		}
+	}
+	if c.Edges[0].Score < c.Edges[1].Score {
+		t.Errorf("scores %v, %v are not descending", c.Edges[0].Score, c.Edges[1].Score)
+	}
+	next, err := SearchRides(ctx, "a*", 2, c.PageInfo.EndCursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next.Edges) != 1 || next.PageInfo.HasNextPage {
+		t.Fatalf("next page %d edges, hasNextPage %v", len(next.Edges), next.PageInfo.HasNextPage)
+	}
+
+	// the same single hit weighs more in shorter destination
+	c, err = SearchRides(ctx, "address", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Edges) != 2 {
+		t.Fatalf("%d edges", len(c.Edges))
+	}
+	if c.Edges[0].Node.id != 2 || c.Edges[0].Score <= c.Edges[1].Score {
+		t.Errorf("edges %+v, %+v", c.Edges[0], c.Edges[1])
+	}
+
+	c, err = SearchRides(ctx, "airport", 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Edges) != 1 {
+		t.Fatalf("%d edges", len(c.Edges))
+	}
+	if want := "<b>Airport</b>, terminal 2, address of <b>airport</b>"; c.Edges[0].Highlight != want {
+		t.Errorf("highlight %q, want %q", c.Edges[0].Highlight, want)
+	}
+
+	for _, q := range []string{`"`, `" OR *`, "NEAR(", "-x"} {
+		if _, err := SearchRides(ctx, q, 10, nil); err != nil {
+			t.Errorf("query %q: %v", q, err)
+		}
+	}
+}
+
+func TestFtsQuery(t *testing.T) {
+	for _, c := range []struct{ text, want string }{
+		{"", ""},
+		{"addr*", `"addr*"`},
+		{"ride 2", `"ride" "2"`},
+		{`say "hi"`, `"say" "hi"`},
+		{`"*`, ""},
+		{"OR NOT", `"OR" "NOT"`},
+	} {
+		if got := ftsQuery(c.text); got != c.want {
+			t.Errorf("ftsQuery(%q) = %s, want %s", c.text, got, c.want)
+		}
+	}
+}
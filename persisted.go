@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ----- persisted queries -----
+
+// Automatic persisted queries, https://www.apollographql.com/docs/apollo-server/performance/apq/
+// client sends extensions.persistedQuery.sha256Hash without query; if server does not know the hash,
+// client gets PersistedQueryNotFound and sends query and hash together, server remembers it.
+// If manifest of operations is loaded (PERSISTED_QUERIES_MANIFEST), server works in allowlist mode:
+// only operations from manifest are executed, they can be referred by hash or sent as is.
+
+type persistedQueryExtension struct {
+	Version    int    `json:"version"`
+	Sha256Hash string `json:"sha256Hash"`
+}
+
+type persistedQueries struct {
+	mu        sync.RWMutex
+	queries   map[string]string // by hash
+	allowlist bool
+}
+
+var persisted = &persistedQueries{queries: map[string]string{}}
+
+// manifest of Apollo format, see https://www.apollographql.com/docs/graphos/operations/persisted-queries
+type persistedQueryManifest struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	Operations []struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+		Body string `json:"body"`
+	} `json:"operations"`
+}
+
+func queryHash(query string) string {
+	h := sha256.Sum256([]byte(query))
+	return hex.EncodeToString(h[:])
+}
+
+// loadPersistedQueryManifest turns allowlist mode on
+func loadPersistedQueryManifest(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var m persistedQueryManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("Invalid manifest %s: %w", path, err)
+	}
+	queries := make(map[string]string, len(m.Operations))
+	for _, o := range m.Operations {
+		if queryHash(o.Body) != o.Id {
+			return fmt.Errorf("Invalid manifest %s: id of operation %s does not match its body", path, o.Name)
+		}
+		queries[o.Id] = o.Body
+	}
+	persisted.mu.Lock()
+	defer persisted.mu.Unlock()
+	persisted.queries = queries
+	persisted.allowlist = true
+	return nil
+}
+
+func (p *persistedQueries) get(hash string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	q, ok := p.queries[hash]
+	return q, ok
+}
+
+// inManifest tells that query comes from manifest, apq registered by clients are not counted
+func (p *persistedQueries) inManifest(hash string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.queries[hash]
+	return ok && p.allowlist // there is no apq registration in allowlist mode
+}
+
+func (p *persistedQueries) put(hash string, query string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queries) >= config.Persisted.CacheSize {
+		for h := range p.queries { // arbitrary one
+			delete(p.queries, h)
+			break
+		}
+	}
+	p.queries[hash] = query
+}
+
+// resolve returns query to be executed
+func (p *persistedQueries) resolve(query string, extensions map[string]interface{}) (string, error) {
+	var pq *persistedQueryExtension
+	if raw, ok := extensions["persistedQuery"]; ok {
+		b, _ := json.Marshal(raw)
+		if json.Unmarshal(b, &pq) != nil || pq == nil || pq.Version != 1 || pq.Sha256Hash == "" {
+			return "", ValidationError("Invalid persistedQuery extension")
+		}
+	}
+	if pq == nil {
+		if query != "" && p.allowlist {
+			if _, ok := p.get(queryHash(query)); !ok {
+				return "", ForbiddenError("Operation is not in allowlist")
+			}
+		}
+		return query, nil
+	}
+	hash := strings.ToLower(pq.Sha256Hash)
+	if query == "" {
+		if q, ok := p.get(hash); ok {
+			return q, nil
+		}
+		if p.allowlist {
+			return "", ForbiddenError("Operation is not in allowlist")
+		}
+		return "", newError(CodePersistedQueryNotFound, "PersistedQueryNotFound")
+	}
+	if queryHash(query) != hash {
+		return "", ValidationError("provided sha does not match query")
+	}
+	if _, ok := p.get(hash); !ok {
+		if p.allowlist {
+			return "", ForbiddenError("Operation is not in allowlist")
+		}
+		p.put(hash, query)
+	}
+	return query, nil
+}
+
+// withPersistedQuery checks and resolves the query handler is going to execute (see peekRequestOptions:
+// url query parameter wins for every method); if it fails, error is sent and false is returned
+func withPersistedQuery(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	fail := func(err error) (*http.Request, bool) {
+		writeResult(w, r, http.StatusOK, rejectedResult(r.Context(), err))
+		return r, false
+	}
+	if isBatchRequest(r) {
+		return r, true // serveBatch resolves every operation
+	}
+	var extensions map[string]interface{}
+	if e := r.URL.Query().Get("extensions"); e != "" {
+		if err := json.Unmarshal([]byte(e), &extensions); err != nil {
+			return fail(ValidationError("Invalid extensions"))
+		}
+	}
+	var body map[string]interface{} // json body
+	if r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		data, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		if json.Unmarshal(data, &body) != nil || body == nil {
+			if persisted.allowlist {
+				return fail(ValidationError("Invalid request body")) // it can not be checked
+			}
+			return r, true // handler reports it
+		}
+		if extensions == nil {
+			extensions, _ = body["extensions"].(map[string]interface{})
+		}
+	}
+	opts := peekRequestOptions(r)
+	query, err := persisted.resolve(opts.Query, extensions)
+	if err != nil {
+		return fail(err)
+	}
+	if query == opts.Query {
+		return r, true
+	}
+	// query is found by hash, request has to carry it
+	values := r.URL.Query()
+	if r.Method == http.MethodGet || values.Get("query") != "" {
+		values.Set("query", query)
+		r = r.Clone(r.Context())
+		r.URL.RawQuery = values.Encode()
+		return r, true
+	}
+	if body != nil {
+		body["query"] = query
+		data, _ := json.Marshal(body)
+		r.Body = io.NopCloser(bytes.NewReader(data))
+		r.ContentLength = int64(len(data))
+		return r, true
+	}
+	return fail(ValidationError("Persisted query can be referred by hash in GET or json POST only"))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func withAllowlist(t *testing.T, queries ...string) {
+	prev := persisted
+	persisted = &persistedQueries{queries: map[string]string{}, allowlist: true}
+	for _, q := range queries {
+		persisted.queries[queryHash(q)] = q
+	}
+	t.Cleanup(func() { persisted = prev })
+}
+
+func TestWithPersistedQueryAllowlist(t *testing.T) {
+	allowed := "{x_ride(id: 1) {id}}"
+	forbidden := "{x_rides(ids: [1 2 3]) {id}}"
+	withAllowlist(t, allowed)
+	extensions := `{"persistedQuery": {"version": 1, "sha256Hash": "` + queryHash(allowed) + `"}}`
+	for _, c := range []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        string
+		ok          bool
+		query       string // to be executed
+	}{
+		{"get allowed", "GET", "/gql?query=" + url.QueryEscape(allowed), "", "", true, allowed},
+		{"get forbidden", "GET", "/gql?query=" + url.QueryEscape(forbidden), "", "", false, ""},
+		{"get by hash", "GET", "/gql?extensions=" + url.QueryEscape(extensions), "", "", true, allowed},
+		{"post allowed", "POST", "/gql", "application/json", `{"query": "` + allowed + `"}`, true, allowed},
+		{"post forbidden", "POST", "/gql", "application/json", `{"query": "` + forbidden + `"}`, false, ""},
+		{"post by hash", "POST", "/gql", "application/json", `{"extensions": ` + extensions + `}`, true, allowed},
+		{"post empty body, forbidden in url", "POST", "/gql?query=" + url.QueryEscape(forbidden), "application/json", `{}`, false, ""},
+		{"post allowed body, forbidden in url", "POST", "/gql?query=" + url.QueryEscape(forbidden), "application/json", `{"query": "` + allowed + `"}`, false, ""},
+		{"post not an object", "POST", "/gql", "application/json", `"` + forbidden + `"`, false, ""},
+		{"post invalid json", "POST", "/gql", "application/json", `{"query":`, false, ""},
+		{"post raw forbidden", "POST", "/gql", "application/graphql", forbidden, false, ""},
+		{"post raw allowed", "POST", "/gql", "application/graphql", allowed, true, allowed},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest(c.method, c.url, strings.NewReader(c.body))
+			if c.contentType != "" {
+				r.Header.Set("Content-Type", c.contentType)
+			}
+			w := httptest.NewRecorder()
+			r, ok := withPersistedQuery(w, r)
+			if ok != c.ok {
+				t.Fatalf("ok = %v, want %v; response %s", ok, c.ok, w.Body.String())
+			}
+			if !ok {
+				if !strings.Contains(w.Body.String(), `"errors"`) {
+					t.Errorf("no errors in response %s", w.Body.String())
+				}
+				return
+			}
+			if q := peekRequestOptions(r).Query; q != c.query {
+				t.Errorf("query to be executed %q, want %q", q, c.query)
+			}
+		})
+	}
+}
+
+func TestWithPersistedQueryRegistersByHash(t *testing.T) {
+	prev := persisted
+	persisted = &persistedQueries{queries: map[string]string{}}
+	t.Cleanup(func() { persisted = prev })
+	query := "{x_ride(id: 2) {id}}"
+	extensions := url.QueryEscape(`{"persistedQuery": {"version": 1, "sha256Hash": "` + queryHash(query) + `"}}`)
+
+	w := httptest.NewRecorder()
+	if _, ok := withPersistedQuery(w, httptest.NewRequest(http.MethodGet, "/gql?extensions="+extensions, nil)); ok {
+		t.Fatal("unknown hash is accepted")
+	}
+	if !strings.Contains(w.Body.String(), string(CodePersistedQueryNotFound)) {
+		t.Errorf("response %s, want %s", w.Body.String(), CodePersistedQueryNotFound)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/gql?extensions="+extensions+"&query="+url.QueryEscape(query), nil)
+	if _, ok := withPersistedQuery(httptest.NewRecorder(), r); !ok {
+		t.Fatal("query with hash is not registered")
+	}
+	r, ok := withPersistedQuery(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/gql?extensions="+extensions, nil))
+	if !ok || peekRequestOptions(r).Query != query {
+		t.Errorf("registered query is not resolved by hash")
+	}
+}
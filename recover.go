@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/graph-gophers/dataloader"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// ----- panic recovery -----
+
+// Panics are caught on every level: resolver (and its thunk), loader batch, goroutine and http handler.
+// Client gets INTERNAL_SERVER_ERROR on the path of failed field, siblings are resolved as usual;
+// panic value and stack are in log only.
+
+// panicError is shown to client instead of panic, its message is masked in production
+func panicError(p interface{}) *Error {
+	return newError(CodeInternalServerError, "Panic: %v", p)
+}
+
+func logPanic(ctx context.Context, msg string, p interface{}, attrs ...any) {
+	attrs = append(attrs, slog.String("panic", fmt.Sprint(p)), slog.String("stack", string(debug.Stack())))
+	slog.ErrorContext(ctx, msg, attrs...)
+}
+
+// recoverField has to be deferred; it turns panic into field error
+func recoverField(p graphql.ResolveParams, result *interface{}, err *error) {
+	if r := recover(); r != nil {
+		logPanic(p.Context, "panic in resolver", r,
+			slog.String("field", p.Info.ParentType.Name()+"."+p.Info.FieldName),
+			slog.Any("path", p.Info.Path.AsArray()))
+		*result, *err = nil, panicError(r)
+	}
+}
+
+// recoveringField wraps resolver and its thunk (if any)
+func recoveringField(resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (result interface{}, err error) {
+		defer recoverField(p, &result, &err)
+		result, err = resolve(p)
+		if thunk, ok := result.(func() (interface{}, error)); ok {
+			return func() (result interface{}, err error) {
+				defer recoverField(p, &result, &err)
+				return thunk()
+			}, err
+		}
+		return result, err
+	}
+}
+
+// recoveringBatch turns panic into errors for every key of batch
+func recoveringBatch(loader string, fn dataloader.BatchFunc) dataloader.BatchFunc {
+	return func(ctx context.Context, keys dataloader.Keys) (results []*dataloader.Result) {
+		defer func() {
+			if r := recover(); r != nil {
+				logPanic(ctx, "panic in batch function", r, slog.String("loader", loader), slog.Int("size", len(keys)))
+				results = make([]*dataloader.Result, len(keys))
+				for i := range results {
+					results[i] = &dataloader.Result{Error: panicError(r)}
+				}
+			}
+		}()
+		return fn(ctx, keys)
+	}
+}
+
+// recoverGoroutine has to be deferred first in goroutines, panic there takes down the process;
+// onPanic (if any) can report failure
+func recoverGoroutine(ctx context.Context, msg string, onPanic func()) {
+	if r := recover(); r != nil {
+		logPanic(ctx, msg, r)
+		if onPanic != nil {
+			onPanic()
+		}
+	}
+}
+
+// internalErrorResult is result of operation failed because of panic out of resolvers
+func internalErrorResult(ctx context.Context) *graphql.Result {
+	errs := []gqlerrors.FormattedError{{Message: maskedMessage, Extensions: newError(CodeInternalServerError, maskedMessage).Extensions()}}
+	addRequestId(ctx, errs)
+	return &graphql.Result{Errors: errs}
+}
+
+// recoverHTTP has to be deferred in handler; response can be broken if it is partly sent already
+func recoverHTTP(w http.ResponseWriter, r *http.Request) {
+	if p := recover(); p != nil {
+		if p == http.ErrAbortHandler { // it is the way to abort response deliberately
+			panic(p)
+		}
+		logPanic(r.Context(), "panic in http handler", p)
+		writeResult(w, r, http.StatusInternalServerError, internalErrorResult(r.Context()))
+	}
+}
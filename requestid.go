@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// ----- request id -----
+
+// Request id is taken from X-Request-ID header (or generated), it is echoed in response,
+// attached to log records and graphql errors and forwarded downstream: to sql statements as comment
+// and to http data sources by requestIdTransport.
+
+const requestIdHeader = "X-Request-ID"
+
+// ids of clients are accepted if they are safe to be put into headers, logs and sql comments
+var requestIdRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+type requestIdKey struct{}
+
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestIdFromRequest(r *http.Request) string {
+	if id := r.Header.Get(requestIdHeader); requestIdRe.MatchString(id) {
+		return id
+	}
+	return newRequestId()
+}
+
+func withRequestId(ctx context.Context, id string) context.Context {
+	return withLogAttrs(context.WithValue(ctx, requestIdKey{}, id), slog.String("request_id", id))
+}
+
+func requestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// sqlWithRequestId prepends statement with comment (sqlcommenter style), it is visible in database side logs
+func sqlWithRequestId(ctx context.Context, sql string) string {
+	if id := requestIdFromContext(ctx); id != "" {
+		return "/* request_id='" + id + "' */ " + sql
+	}
+	return sql
+}
+
+// requestIdTransport forwards request id to http data sources
+type requestIdTransport struct {
+	base http.RoundTripper
+}
+
+func (t requestIdTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if id := requestIdFromContext(r.Context()); id != "" && r.Header.Get(requestIdHeader) == "" {
+		r = r.Clone(r.Context()) // RoundTripper must not modify request
+		r.Header.Set(requestIdHeader, id)
+	}
+	return t.base.RoundTrip(r)
+}
+
+// downstreamClient is to be used by http data sources; requests have to be made with context of resolver
+var downstreamClient = &http.Client{Transport: requestIdTransport{http.DefaultTransport}}
+
+// requestIdExtension puts request id into extensions of errors.
+// Validation and execution errors are covered; parse errors get it in document(), extensions get no result of parsing.
+type requestIdExtension struct{}
+
+func (requestIdExtension) Init(ctx context.Context, p *graphql.Params) context.Context { return ctx }
+
+func (requestIdExtension) Name() string { return "requestId" }
+
+func (requestIdExtension) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+	return ctx, func(error) {}
+}
+
+func (requestIdExtension) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+	return ctx, func(errs []gqlerrors.FormattedError) {
+		addRequestId(ctx, errs) // errs share array with result
+	}
+}
+
+func (requestIdExtension) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+	return ctx, func(r *graphql.Result) {
+		addRequestId(ctx, r.Errors)
+	}
+}
+
+func (requestIdExtension) ResolveFieldDidStart(ctx context.Context, i *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+	return ctx, func(interface{}, error) {}
+}
+
+func (requestIdExtension) HasResult() bool { return false }
+
+func (requestIdExtension) GetResult(context.Context) interface{} { return nil }
+
+func addRequestId(ctx context.Context, errs []gqlerrors.FormattedError) {
+	id := requestIdFromContext(ctx)
+	if id == "" {
+		return
+	}
+	for i := range errs {
+		if errs[i].Extensions == nil {
+			errs[i].Extensions = map[string]interface{}{}
+		}
+		errs[i].Extensions["request_id"] = id
+	}
+}
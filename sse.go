@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/handler"
+)
+
+// ----- graphql over server-sent events -----
+
+// graphql-sse protocol, "distinct connections mode", see https://github.com/enisdenjo/graphql-sse/blob/master/PROTOCOL.md
+// Every subscription result carries id, it is sequence number of event from event bus.
+// Reconnected client sends Last-Event-ID and gets all missed events, that are still kept by bus.
+
+func isEventStreamRequest(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+type sseWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func (s *sseWriter) event(id string, event string, data []byte) error {
+	var b strings.Builder
+	if id != "" {
+		b.WriteString("id: " + id + "\n")
+	}
+	b.WriteString("event: " + event + "\n")
+	b.WriteString("data: ")
+	b.Write(data) // compact json, no new lines inside
+	b.WriteString("\n\n")
+	_, err := s.w.Write([]byte(b.String()))
+	s.flusher.Flush()
+	return err
+}
+
+func (s *sseWriter) heartbeat() error {
+	_, err := s.w.Write([]byte(":\n\n")) // comment, it is ignored by clients
+	s.flusher.Flush()
+	return err
+}
+
+func (s *sseWriter) next(id string, result *graphql.Result) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return s.event(id, "next", data)
+}
+
+func serveEventStream(schema *graphql.Schema, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	opts := handler.NewRequestOptions(r)
+	if opts.Query == "" {
+		http.Error(w, "Missing query", http.StatusBadRequest)
+		return
+	}
+	var replayAfter *uint64
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		id, err := strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+		replayAfter = &id
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // ask nginx-like proxies not to buffer stream
+	unlimitedStream(w, false)
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush() // client sees stream opened before first event
+	s := &sseWriter{w: w, flusher: flusher}
+
+	ctx, cancel := context.WithCancel(r.Context()) // canceled on client disconnect too
+	defer cancel()
+	ctx, seqQueue := withEventSeq(subscriptionContext(ctx), replayAfter)
+	params := graphql.Params{
+		Schema:         *schema,
+		RequestString:  opts.Query,
+		VariableValues: opts.Variables,
+		OperationName:  opts.OperationName,
+		Context:        ctx,
+	}
+
+	if err := checkQueryLimits(schema, opts.Query, opts.OperationName, opts.Variables); err != nil {
+		if s.next("", rejectedResult(ctx, err)) == nil {
+			s.event("", "complete", nil)
+		}
+		return
+	}
+	if t, err := operationType(opts.Query, opts.OperationName); err != nil || t != ast.OperationTypeSubscription {
+		if s.next("", executeQuery(params)) == nil {
+			s.event("", "complete", nil)
+		}
+		return
+	}
+
+	slog.InfoContext(ctx, "event stream opened")
+	defer slog.InfoContext(ctx, "event stream closed")
+	heartbeat := time.NewTicker(config.Subscriptions.SSEHeartbeat)
+	defer heartbeat.Stop()
+	results := graphql.Subscribe(params)
+	defer drainResults(cancel, results)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stopping:
+			return // without complete: client reconnects with Last-Event-ID
+		case <-heartbeat.C:
+			if s.heartbeat() != nil {
+				return
+			}
+		case result, ok := <-results:
+			if !ok {
+				s.event("", "complete", nil)
+				return
+			}
+			classifySubscriptionErrors(ctx, result)
+			id := ""
+			select {
+			case seq := <-seqQueue:
+				id = strconv.FormatUint(seq, 10)
+			default: // result without event, i.e. request error
+			}
+			if s.next(id, result) != nil {
+				return
+			}
+			if result.Data == nil && result.HasErrors() {
+				s.event("", "complete", nil)
+				return
+			}
+		}
+	}
+}
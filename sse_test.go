@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+type testRequestKey struct{}
+
+// sseTestServer serves event streams of schema with subscription tick, its events are sent to returned channel;
+// contexts of subscriptions are sent to subscribed
+func sseTestServer(t *testing.T) (server *httptest.Server, ticks chan int, subscribed chan context.Context) {
+	ticks = make(chan int)
+	subscribed = make(chan context.Context, 1)
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name:   "Query",
+		Fields: graphql.Fields{"hello": &graphql.Field{Type: graphql.String, Resolve: func(graphql.ResolveParams) (interface{}, error) { return "world", nil }}},
+	})
+	subscription := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"tick": &graphql.Field{
+				Type: graphql.Int,
+				Subscribe: func(p graphql.ResolveParams) (interface{}, error) {
+					subscribed <- p.Context
+					out := make(chan interface{})
+					go func() {
+						defer close(out)
+						for {
+							select {
+							case <-p.Context.Done():
+								return
+							case n, ok := <-ticks:
+								if !ok {
+									return
+								}
+								out <- n
+							}
+						}
+					}()
+					return out, nil
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) { return p.Source, nil },
+			},
+			"boom": &graphql.Field{
+				Type:      graphql.Int,
+				Subscribe: func(p graphql.ResolveParams) (interface{}, error) { panic("boom") },
+			},
+		},
+	})
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{"touch": &graphql.Field{Type: graphql.Boolean, Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if r, ok := p.Context.Value(testRequestKey{}).(*http.Request); ok && r.Method == http.MethodGet {
+				t.Errorf("mutation is executed by GET")
+			}
+			return true, nil
+		}}},
+	})
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation, Subscription: subscription})
+	if err != nil {
+		t.Fatal(err)
+	}
+	instrumentResolvers(&schema)
+	h := handlerWrapper(nil, &schema) // the whole way of request, not event stream only
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), testRequestKey{}, r)))
+	}))
+	t.Cleanup(server.Close)
+	return server, ticks, subscribed
+}
+
+func openEventStream(t *testing.T, ctx context.Context, url string, query string) (*http.Response, *bufio.Reader) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(query))
+	req.Header.Set("Content-Type", "application/graphql")
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp, bufio.NewReader(resp.Body)
+}
+
+// readEvent returns lines of next event (or comment), without blank line after it
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	t.Helper()
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("event is not read: %v (got %q)", err, lines)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestEventStreamHeaders(t *testing.T) {
+	server, _, _ := sseTestServer(t)
+	resp, _ := openEventStream(t, context.Background(), server.URL, "subscription { tick }")
+	for k, want := range map[string]string{
+		"Content-Type":      "text/event-stream; charset=utf-8",
+		"Cache-Control":     "no-cache",
+		"X-Accel-Buffering": "no",
+	} {
+		if got := resp.Header.Get(k); got != want {
+			t.Errorf("%s: %q, want %q", k, got, want)
+		}
+	}
+}
+
+func TestEventStreamFraming(t *testing.T) {
+	server, ticks, _ := sseTestServer(t)
+	_, r := openEventStream(t, context.Background(), server.URL, "subscription { tick }")
+	for _, n := range []string{"1", "2"} {
+		go func() { ticks <- int(n[0] - '0') }()
+		got := readEvent(t, r)
+		want := []string{"event: next", `data: {"data":{"tick":` + n + `}}`}
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("event %q, want %q", got, want)
+		}
+	}
+	close(ticks)
+	if got := readEvent(t, r); strings.Join(got, "\n") != "event: complete\ndata: " {
+		t.Errorf("event %q, want complete", got)
+	}
+}
+
+func TestEventStreamQuery(t *testing.T) {
+	server, _, _ := sseTestServer(t)
+	_, r := openEventStream(t, context.Background(), server.URL, "{ hello }")
+	if got := readEvent(t, r); strings.Join(got, "\n") != "event: next\n"+`data: {"data":{"hello":"world"}}` {
+		t.Errorf("event %q", got)
+	}
+	if got := readEvent(t, r); got[0] != "event: complete" {
+		t.Errorf("event %q, want complete", got)
+	}
+}
+
+func TestEventStreamHeartbeat(t *testing.T) {
+	prev := config.Subscriptions.SSEHeartbeat
+	config.Subscriptions.SSEHeartbeat = 10 * time.Millisecond
+	t.Cleanup(func() { config.Subscriptions.SSEHeartbeat = prev })
+	server, _, _ := sseTestServer(t)
+	_, r := openEventStream(t, context.Background(), server.URL, "subscription { tick }")
+	for i := 0; i < 2; i++ {
+		if got := readEvent(t, r); strings.Join(got, "\n") != ":" {
+			t.Errorf("heartbeat %q, want comment", got)
+		}
+	}
+}
+
+func TestEventStreamClientDisconnect(t *testing.T) {
+	server, _, subscribed := sseTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	openEventStream(t, ctx, server.URL, "subscription { tick }")
+	var subscription context.Context
+	select {
+	case subscription = <-subscribed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("not subscribed")
+	}
+	cancel()
+	select {
+	case <-subscription.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("subscription is alive after client disconnect")
+	}
+}
+
+func TestEventStreamGETAcceptsQueriesOnly(t *testing.T) {
+	server, _, _ := sseTestServer(t)
+	for _, c := range []struct {
+		name   string
+		params url.Values
+		status int
+	}{
+		{"query", url.Values{"query": {"{ hello }"}}, http.StatusOK},
+		{"subscription", url.Values{"query": {"subscription { tick }"}}, http.StatusOK},
+		{"mutation", url.Values{"query": {"mutation { touch }"}}, http.StatusMethodNotAllowed},
+		{"mutation by name", url.Values{"query": {"query Q { hello } mutation M { touch }"}, "operationName": {"M"}}, http.StatusMethodNotAllowed},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel() // subscription is endless
+			req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?"+c.params.Encode(), nil)
+			req.Header.Set("Accept", "text/event-stream")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != c.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, c.status)
+			}
+			if c.status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") != http.MethodPost {
+				t.Errorf("Allow: %q", resp.Header.Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestEventStreamReplay(t *testing.T) {
+	schema := serviceSchema(t)
+	prevAuth, prevEvents := authenticators, rideEvents
+	authenticators = []authenticator{func(h http.Header) (*Principal, error) {
+		return &Principal{UserId: h.Get("X-Test-Customer"), Role: RoleCustomer}, nil
+	}}
+	rideEvents = NewEventBus()
+	t.Cleanup(func() { authenticators, rideEvents = prevAuth, prevEvents })
+	server := httptest.NewServer(handlerWrapper(nil, schema))
+	t.Cleanup(server.Close)
+
+	ctx := context.Background()
+	sql(ctx, "insert into Customer values (200, 'Customer_200')")
+	sql(ctx, "insert into Ride (ride_id, driver_id, customer_id, destination) values (4, 1, 200, 'Address_for_ride_4')")
+	publish := func(rideId int) {
+		row := sql(ctx, "select * from Ride where ride_id = ?", rideId)[0]
+		rideEvents.Publish(Event{Topic: TopicRideAdded, Ride: NewCompleteRide(row)})
+	}
+	for _, id := range []int{1, 2, 4, 3} { // seq 1..4, ride 4 is of other customer
+		publish(id)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, server.URL, strings.NewReader("subscription { rideAdded { id } }"))
+	req.Header.Set("Content-Type", "application/graphql")
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "1")
+	req.Header.Set("X-Test-Customer", "100")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	r := bufio.NewReader(resp.Body)
+	next := func(seq string, rideId string) {
+		t.Helper()
+		want := []string{"id: " + seq, "event: next", `data: {"data":{"rideAdded":{"id":` + rideId + `}}}`}
+		if got := readEvent(t, r); strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("event %q, want %q", got, want)
+		}
+	}
+	next("2", "2") // seq 1 is seen by client, seq 3 is not for this customer
+	next("4", "3")
+	publish(1) // live events follow replayed ones
+	next("5", "1")
+}
+
+func TestEventStreamSubscribePanic(t *testing.T) {
+	server, _, _ := sseTestServer(t)
+	_, r := openEventStream(t, context.Background(), server.URL, "subscription { boom }")
+	if got := readEvent(t, r); len(got) != 2 || !strings.Contains(got[1], `"code":"INTERNAL_SERVER_ERROR"`) {
+		t.Errorf("event %q, want error", got)
+	}
+	if got := readEvent(t, r); got[0] != "event: complete" {
+		t.Errorf("event %q, want complete", got)
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/graph-gophers/dataloader"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// ----- subscriptions -----
+
+// SubscriptionsConfig is config.Subscriptions
+type SubscriptionsConfig struct {
+	HistorySize    int           `config:"history_size" help:"latest events kept to be replayed by Last-Event-ID"`
+	SSEHeartbeat   time.Duration `config:"sse_heartbeat" help:"interval of comments keeping idle event streams alive"`
+	WSInitTimeout  time.Duration `config:"ws_init_timeout" help:"websocket is closed if connection_init is not received in time"`
+	WSWriteTimeout time.Duration `config:"ws_write_timeout" help:"max duration of writing websocket message (pong too)"`
+}
+
+func (c SubscriptionsConfig) validate() error {
+	if c.HistorySize <= 0 || c.SSEHeartbeat <= 0 || c.WSInitTimeout <= 0 || c.WSWriteTimeout <= 0 {
+		return fmt.Errorf("Subscriptions history size, heartbeat interval and websocket timeouts have to be positive")
+	}
+	return nil
+}
+
+// Context keys to let transport (see sse.go) know sequence numbers of events behind results
+
+type replayAfterKey struct{}
+
+type eventSeqQueueKey struct{}
+
+// withEventSeq asks subscribeRides to replay events after given sequence number and
+// to report sequence number of every passed event to returned queue, one per result, in the same order
+func withEventSeq(ctx context.Context, replayAfter *uint64) (context.Context, chan uint64) {
+	queue := make(chan uint64, 4) // results are produced one by one, so there are two seqs in queue at most
+	ctx = context.WithValue(ctx, eventSeqQueueKey{}, queue)
+	if replayAfter != nil {
+		ctx = context.WithValue(ctx, replayAfterKey{}, *replayAfter)
+	}
+	return ctx, queue
+}
+
+// subscribeRides bridges event bus to graphql.Subscribe: events of topic are passed while ctx is alive
+func subscribeRides(ctx context.Context, topic string, filter func(Event) bool) chan interface{} {
+	var events <-chan Event
+	var unsubscribe func()
+	if after, ok := ctx.Value(replayAfterKey{}).(uint64); ok {
+		events, unsubscribe = rideEvents.SubscribeAfter(topic, filter, after)
+	} else {
+		events, unsubscribe = rideEvents.Subscribe(topic, filter)
+	}
+	seqQueue, _ := ctx.Value(eventSeqQueueKey{}).(chan uint64)
+	out := make(chan interface{})
+	go func() {
+		defer close(out)
+		defer unsubscribe()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-events:
+				if !ok {
+					return
+				}
+				if seqQueue != nil {
+					select {
+					case seqQueue <- e.Seq:
+					case <-ctx.Done():
+						return
+					}
+				}
+				select {
+				case out <- e.Ride:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// drainResults cancels subscription and reads its results until graphql.Subscribe closes channel:
+// goroutine of library sends results without looking at context, it would be blocked forever
+func drainResults(cancel context.CancelFunc, results chan *graphql.Result) {
+	cancel()
+	for range results {
+	}
+}
+
+// classifySubscriptionErrors gives codes to errors of graphql.Subscribe itself (subscribe function failed):
+// they are formatted without extensions and extensions of schema are not called for them
+func classifySubscriptionErrors(ctx context.Context, result *graphql.Result) {
+	for i := range result.Errors {
+		if e, ok := result.Errors[i].OriginalError().(gqlerrors.ExtendedError); ok && result.Errors[i].Extensions == nil {
+			result.Errors[i].Extensions = e.Extensions()
+		}
+	}
+	classifyErrors(ctx, result.Errors, CodeInternal)
+	addRequestId(ctx, result.Errors)
+}
+
+// operationType returns "query", "mutation" or "subscription"; error means invalid document,
+// in this case caller can pass it to executeQuery to get complete error report
+func operationType(query string, operationName string) (string, error) {
+	doc, err := parsedDocument(query)
+	if err != nil {
+		return "", err
+	}
+	var found *ast.OperationDefinition
+	for _, d := range doc.Definitions {
+		op, ok := d.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		if operationName == "" {
+			if found != nil {
+				return "", errors.New("Must provide operation name if query contains multiple operations")
+			}
+			found = op
+		} else if op.Name != nil && op.Name.Value == operationName {
+			found = op
+		}
+	}
+	if found == nil {
+		return "", errors.New("Unknown operation " + operationName)
+	}
+	return found.Operation, nil
+}
+
+// subscriptionContext makes context for long living operation: loaders do not cache,
+// every event is resolved with fresh data, but requests are still batched
+func subscriptionContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, "dataloaders", NewLoaders(dataloader.WithCache(&dataloader.NoCache{})))
+}
+
+// ----- graphql over websocket -----
+
+// graphql-transport-ws protocol, see https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+
+const (
+	wsProtocol          = "graphql-transport-ws"
+	wsMaxMessageSize    = 1 << 20
+	wsCloseBadRequest   = 4400
+	wsCloseUnauthorized = 4401
+	wsCloseForbidden    = 4403
+	wsCloseInitTimeout  = 4408
+	wsCloseDuplicateId  = 4409
+	wsCloseTooManyInits = 4429
+)
+
+type wsMessage struct {
+	Id      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type wsSubscribePayload struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+	Extensions    map[string]interface{} `json:"extensions"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	Subprotocols: []string{wsProtocol},
+	CheckOrigin:  checkWebSocketOrigin, // browsers do not apply cors to websockets
+}
+
+type wsConnection struct {
+	schema     *graphql.Schema
+	conn       *websocket.Conn
+	writeMu    sync.Mutex
+	mu         sync.Mutex
+	initDone   bool
+	principal  *Principal
+	operations map[string]context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+func serveWebSocket(schema *graphql.Schema, w http.ResponseWriter, r *http.Request) {
+	principal, err := authenticate(r.Header) // browsers can not set headers, see connection_init too
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="gql"`)
+		writeResult(w, r, http.StatusUnauthorized, rejectedResult(r.Context(), err))
+		return
+	}
+	unlimitedStream(w, true)
+	conn, err := wsUpgrader.Upgrade(w, r, w.Header()) // X-Request-ID
+	if err != nil {
+		return // upgrader has already replied
+	}
+	streams.Add(1)
+	defer streams.Done()
+	c := &wsConnection{
+		schema:     schema,
+		conn:       conn,
+		principal:  principal,
+		operations: map[string]context.CancelFunc{},
+	}
+	if conn.Subprotocol() != wsProtocol {
+		c.close(websocket.CloseProtocolError, "Subprotocol not acceptable")
+		return
+	}
+	conn.SetReadLimit(wsMaxMessageSize)
+	ctx, cancel := context.WithCancel(r.Context())
+	defer func() {
+		cancel() // stops all operations
+		c.wg.Wait()
+		conn.Close()
+		slog.InfoContext(ctx, "websocket closed")
+	}()
+	slog.InfoContext(ctx, "websocket opened")
+	initTimer := time.AfterFunc(config.Subscriptions.WSInitTimeout, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if !c.initDone {
+			c.close(wsCloseInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	defer initTimer.Stop()
+	go func() {
+		select {
+		case <-stopping:
+			c.close(websocket.CloseGoingAway, "Server is shutting down") // reader fails, operations are stopped
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				c.close(wsCloseBadRequest, "Invalid message received")
+			}
+			return
+		}
+		if !c.handle(ctx, msg) {
+			return
+		}
+	}
+}
+
+// handle processes one client message; false means connection has to be closed
+func (c *wsConnection) handle(ctx context.Context, msg wsMessage) bool {
+	switch msg.Type {
+	case "connection_init":
+		c.mu.Lock()
+		again := c.initDone
+		c.initDone = true
+		c.mu.Unlock()
+		if again {
+			c.close(wsCloseTooManyInits, "Too many initialisation requests")
+			return false
+		}
+		p, err := authenticate(initPayloadHeaders(msg.Payload))
+		c.mu.Lock()
+		if p == nil && err == nil {
+			p = c.principal // from handshake
+		}
+		c.principal = p
+		c.mu.Unlock()
+		if err == nil {
+			err = checkAuthenticated(p)
+		}
+		if err != nil {
+			c.close(wsCloseForbidden, "Forbidden")
+			return false
+		}
+		c.write(wsMessage{Type: "connection_ack"})
+	case "ping":
+		c.write(wsMessage{Type: "pong", Payload: msg.Payload})
+	case "pong":
+	case "subscribe":
+		c.mu.Lock()
+		initDone := c.initDone
+		_, exists := c.operations[msg.Id]
+		c.mu.Unlock()
+		if !initDone {
+			c.close(wsCloseUnauthorized, "Unauthorized")
+			return false
+		}
+		if exists {
+			c.close(wsCloseDuplicateId, "Subscriber for "+msg.Id+" already exists")
+			return false
+		}
+		var payload wsSubscribePayload
+		if msg.Id == "" || json.Unmarshal(msg.Payload, &payload) != nil {
+			c.close(wsCloseBadRequest, "Invalid subscribe message")
+			return false
+		}
+		c.start(ctx, msg.Id, payload)
+	case "complete":
+		c.mu.Lock()
+		if cancel, ok := c.operations[msg.Id]; ok {
+			cancel()
+			delete(c.operations, msg.Id)
+		}
+		c.mu.Unlock()
+	default:
+		c.close(wsCloseBadRequest, "Invalid message type "+msg.Type)
+		return false
+	}
+	return true
+}
+
+func (c *wsConnection) start(ctx context.Context, id string, payload wsSubscribePayload) {
+	opCtx, cancel := context.WithCancel(ctx)
+	c.mu.Lock()
+	c.operations[id] = cancel
+	opCtx = withPrincipal(opCtx, c.principal)
+	c.mu.Unlock()
+	params := graphql.Params{
+		Schema:         *c.schema,
+		RequestString:  payload.Query,
+		VariableValues: payload.Variables,
+		OperationName:  payload.OperationName,
+		Context:        subscriptionContext(opCtx),
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		defer func() {
+			c.mu.Lock()
+			if _, ok := c.operations[id]; ok { // operation is finished by server, not by client
+				delete(c.operations, id)
+				if opCtx.Err() == nil {
+					c.write(wsMessage{Id: id, Type: "complete"})
+				}
+			}
+			c.mu.Unlock()
+			cancel()
+		}()
+		defer recoverGoroutine(opCtx, "panic in websocket operation", func() { c.next(id, internalErrorResult(opCtx)) }) // before complete
+		query, err := persisted.resolve(payload.Query, payload.Extensions)
+		if err != nil {
+			c.next(id, rejectedResult(opCtx, err))
+			return
+		}
+		params.RequestString = query
+		if err := checkQueryLimits(c.schema, query, payload.OperationName, payload.Variables); err != nil {
+			c.next(id, rejectedResult(opCtx, err))
+			return
+		}
+		if t, err := operationType(query, payload.OperationName); err != nil || t != ast.OperationTypeSubscription {
+			c.next(id, executeQuery(params))
+			return
+		}
+		results := graphql.Subscribe(params)
+		defer drainResults(cancel, results)
+		for {
+			select {
+			case <-opCtx.Done():
+				return
+			case result, ok := <-results:
+				if !ok {
+					return
+				}
+				classifySubscriptionErrors(opCtx, result)
+				if !c.next(id, result) {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// next sends result; request errors (result without data) are reported as error message,
+// false means operation is over
+func (c *wsConnection) next(id string, result *graphql.Result) bool {
+	if result.Data == nil && result.HasErrors() {
+		c.mu.Lock()
+		delete(c.operations, id) // error message terminates operation, no complete required
+		c.mu.Unlock()
+		payload, _ := json.Marshal(result.Errors)
+		c.write(wsMessage{Id: id, Type: "error", Payload: payload})
+		return false
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		payload, _ = json.Marshal(graphql.Result{Errors: []gqlerrors.FormattedError{gqlerrors.FormatError(err)}})
+	}
+	c.write(wsMessage{Id: id, Type: "next", Payload: payload})
+	return true
+}
+
+func (c *wsConnection) write(msg wsMessage) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(config.Subscriptions.WSWriteTimeout))
+	c.conn.WriteJSON(msg) // errors will be caught by reader
+}
+
+func (c *wsConnection) close(code int, reason string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(config.Subscriptions.WSWriteTimeout))
+	c.conn.Close()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/graphql-go/graphql"
+)
+
+func TestDrainResults(t *testing.T) {
+	source := make(chan interface{}, 1)
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: graphql.Fields{"a": &graphql.Field{Type: graphql.Int}}}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{Name: "Subscription", Fields: graphql.Fields{"tick": &graphql.Field{
+			Type:      graphql.Int,
+			Subscribe: func(p graphql.ResolveParams) (interface{}, error) { return source, nil },
+			Resolve:   func(p graphql.ResolveParams) (interface{}, error) { return p.Source, nil },
+		}}}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	results := graphql.Subscribe(graphql.Params{Schema: schema, RequestString: "subscription { tick }", Context: ctx})
+	source <- 1 // nobody reads results: library takes event and blocks on sending its result
+	time.Sleep(10 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		drainResults(cancel, results)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("results channel is not closed")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ----- opentelemetry -----
+
+// Spans: http request (parent is taken from W3C traceparent header) -> resolvers -> loader batches -> sql.
+// Exporter is chosen by TRACES_EXPORTER environment variable: "stdout", "file:<path>" or nothing (tracing is off).
+// Add your own exporter (otlp, for instance) to traceExporters.
+
+const instrumentationName = "github.com/michurin/playground-graphql-go"
+
+var traceExporters = map[string]func(arg string) (sdktrace.SpanExporter, error){
+	"stdout": func(string) (sdktrace.SpanExporter, error) {
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	},
+	"file": func(path string) (sdktrace.SpanExporter, error) {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		return stdouttrace.New(stdouttrace.WithWriter(f))
+	},
+}
+
+// setupTelemetry installs tracer provider according to exporter spec ("name" or "name:arg");
+// it returns function to flush spans and shut provider down
+func setupTelemetry(spec string) (func(context.Context) error, error) {
+	if spec == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	name, arg := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, arg = spec[:i], spec[i+1:]
+	}
+	newExporter, ok := traceExporters[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown traces exporter %q", name)
+	}
+	exporter, err := newExporter(arg)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "playground-graphql-go"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	instruments = append(instruments, telemetryInstrument)
+	return provider.Shutdown, nil
+}
+
+func otelTracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startHTTPSpan continues trace of caller (if any); without installed provider it costs almost nothing
+func startHTTPSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := otelTracer().Start(ctx, r.Method+" "+r.URL.Path,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("user_agent.original", r.UserAgent()),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+var telemetryInstrument = Instrument{
+	Field: func(ctx context.Context, info graphql.ResolveInfo) (context.Context, func(error)) {
+		path := make([]string, 0)
+		for _, e := range info.Path.AsArray() {
+			path = append(path, fmt.Sprint(e))
+		}
+		ctx, span := otelTracer().Start(ctx, info.ParentType.Name()+"."+info.FieldName,
+			trace.WithAttributes(
+				attribute.String("graphql.field.name", info.FieldName),
+				attribute.String("graphql.field.path", strings.Join(path, ".")),
+				attribute.String("graphql.field.type", info.ReturnType.String()),
+				attribute.String("graphql.parent_type", info.ParentType.Name()),
+			),
+		)
+		return ctx, func(err error) { endSpan(span, err) }
+	},
+	Batch: func(ctx context.Context, loader string, size int) (context.Context, func()) {
+		ctx, span := otelTracer().Start(ctx, "dataloader "+loader,
+			trace.WithAttributes(
+				attribute.String("dataloader.name", loader),
+				attribute.Int("dataloader.batch_size", size),
+			),
+		)
+		return ctx, func() { span.End() }
+	},
+	SQL: func(ctx context.Context, query string) (context.Context, func(int, error)) {
+		template := sqlTemplate(query) // never export values
+		name := "sqlite"
+		if words := strings.Fields(template); len(words) > 0 {
+			name += " " + strings.ToLower(words[0])
+		}
+		ctx, span := otelTracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "sqlite"),
+				attribute.String("db.name", config.Database),
+				attribute.String("db.statement", template),
+			),
+		)
+		return ctx, func(rows int, err error) {
+			span.SetAttributes(attribute.Int("db.rows", rows))
+			endSpan(span, err)
+		}
+	},
+}
+
+// telemetryExtension labels http span with graphql operation
+type telemetryExtension struct{}
+
+func (telemetryExtension) Init(ctx context.Context, p *graphql.Params) context.Context {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return ctx
+	}
+	span.SetAttributes(attribute.String("graphql.operation.name", p.OperationName))
+	if t, err := operationType(p.RequestString, p.OperationName); err == nil {
+		span.SetAttributes(attribute.String("graphql.operation.type", t))
+	}
+	return ctx
+}
+
+func (telemetryExtension) Name() string { return "telemetry" }
+
+func (telemetryExtension) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+	return ctx, func(error) {}
+}
+
+func (telemetryExtension) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+	return ctx, func(errs []gqlerrors.FormattedError) {
+		if len(errs) > 0 {
+			trace.SpanFromContext(ctx).SetStatus(codes.Error, errs[0].Message)
+		}
+	}
+}
+
+func (telemetryExtension) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+	return ctx, func(r *graphql.Result) {
+		if r.HasErrors() {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Int("graphql.errors", len(r.Errors)))
+		}
+	}
+}
+
+func (telemetryExtension) ResolveFieldDidStart(ctx context.Context, i *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+	return ctx, func(interface{}, error) {} // see telemetryInstrument
+}
+
+func (telemetryExtension) HasResult() bool { return false }
+
+func (telemetryExtension) GetResult(context.Context) interface{} { return nil }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+)
+
+// ----- apollo tracing -----
+
+// https://github.com/apollographql/apollo-tracing
+// Resolver timings cover thunks: resolver is finished when its thunk is done.
+// Non-standard extras: dataloader batches and sql statements (templates, without values) are in execution.batches and execution.sql.
+// Tracing shows internals, so in production it is off unless config.ApolloTracing is set.
+
+type tracingKey struct{}
+
+type tracingPhase struct {
+	StartOffset int64 `json:"startOffset"`
+	Duration    int64 `json:"duration"`
+}
+
+type tracingResolver struct {
+	Path        []interface{} `json:"path"`
+	ParentType  string        `json:"parentType"`
+	FieldName   string        `json:"fieldName"`
+	ReturnType  string        `json:"returnType"`
+	StartOffset int64         `json:"startOffset"`
+	Duration    int64         `json:"duration"`
+}
+
+type tracingBatch struct {
+	Loader      string `json:"loader"`
+	Size        int    `json:"size"`
+	StartOffset int64  `json:"startOffset"`
+	Duration    int64  `json:"duration"`
+}
+
+type tracingSQL struct {
+	Query       string `json:"query"`
+	Rows        int    `json:"rows"`
+	StartOffset int64  `json:"startOffset"`
+	Duration    int64  `json:"duration"`
+}
+
+type tracer struct {
+	mu         sync.Mutex
+	start      time.Time
+	parsing    *tracingPhase
+	validation *tracingPhase
+	resolvers  []tracingResolver
+	batches    []tracingBatch
+	sql        []tracingSQL
+}
+
+func tracerFromContext(ctx context.Context) *tracer {
+	t, _ := ctx.Value(tracingKey{}).(*tracer)
+	return t
+}
+
+func (t *tracer) offset(tm time.Time) int64 {
+	return tm.Sub(t.start).Nanoseconds()
+}
+
+func (t *tracer) result() map[string]interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	end := time.Now()
+	r := map[string]interface{}{
+		"version":   1,
+		"startTime": t.start.UTC().Format(time.RFC3339Nano),
+		"endTime":   end.UTC().Format(time.RFC3339Nano),
+		"duration":  end.Sub(t.start).Nanoseconds(),
+		"execution": map[string]interface{}{
+			"resolvers": append([]tracingResolver{}, t.resolvers...),
+			"batches":   append([]tracingBatch{}, t.batches...),
+			"sql":       append([]tracingSQL{}, t.sql...),
+		},
+	}
+	if t.parsing != nil {
+		r["parsing"] = t.parsing
+	}
+	if t.validation != nil {
+		r["validation"] = t.validation
+	}
+	return r
+}
+
+var tracingInstrument = Instrument{
+	Field: func(ctx context.Context, info graphql.ResolveInfo) (context.Context, func(error)) {
+		t := tracerFromContext(ctx)
+		if t == nil {
+			return ctx, func(error) {}
+		}
+		start := time.Now()
+		return ctx, func(error) {
+			r := tracingResolver{
+				Path:        info.Path.AsArray(),
+				ParentType:  info.ParentType.Name(),
+				FieldName:   info.FieldName,
+				ReturnType:  info.ReturnType.String(),
+				StartOffset: t.offset(start),
+				Duration:    time.Since(start).Nanoseconds(),
+			}
+			t.mu.Lock()
+			t.resolvers = append(t.resolvers, r)
+			t.mu.Unlock()
+		}
+	},
+	Batch: func(ctx context.Context, loader string, size int) (context.Context, func()) {
+		t := tracerFromContext(ctx)
+		if t == nil {
+			return ctx, func() {}
+		}
+		start := time.Now()
+		return ctx, func() {
+			b := tracingBatch{
+				Loader:      loader,
+				Size:        size,
+				StartOffset: t.offset(start),
+				Duration:    time.Since(start).Nanoseconds(),
+			}
+			t.mu.Lock()
+			t.batches = append(t.batches, b)
+			t.mu.Unlock()
+		}
+	},
+	SQL: func(ctx context.Context, query string) (context.Context, func(int, error)) {
+		t := tracerFromContext(ctx)
+		if t == nil {
+			return ctx, func(int, error) {}
+		}
+		template := sqlTemplate(query) // values are never shown
+		start := time.Now()
+		return ctx, func(rows int, err error) {
+			s := tracingSQL{
+				Query:       template,
+				Rows:        rows,
+				StartOffset: t.offset(start),
+				Duration:    time.Since(start).Nanoseconds(),
+			}
+			t.mu.Lock()
+			t.sql = append(t.sql, s)
+			t.mu.Unlock()
+		}
+	},
+}
+
+// tracingExtension measures parsing and validation; it has no result by itself,
+// because result has to be shown only on demand, see withTracing
+type tracingExtension struct{}
+
+func (tracingExtension) Init(ctx context.Context, p *graphql.Params) context.Context { return ctx }
+
+func (tracingExtension) Name() string { return "tracing" }
+
+func (tracingExtension) ParseDidStart(ctx context.Context) (context.Context, graphql.ParseFinishFunc) {
+	t := tracerFromContext(ctx)
+	start := time.Now()
+	return ctx, func(error) {
+		if t != nil {
+			t.mu.Lock()
+			t.parsing = &tracingPhase{StartOffset: t.offset(start), Duration: time.Since(start).Nanoseconds()}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (tracingExtension) ValidationDidStart(ctx context.Context) (context.Context, graphql.ValidationFinishFunc) {
+	t := tracerFromContext(ctx)
+	start := time.Now()
+	return ctx, func([]gqlerrors.FormattedError) {
+		if t != nil {
+			t.mu.Lock()
+			t.validation = &tracingPhase{StartOffset: t.offset(start), Duration: time.Since(start).Nanoseconds()}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (tracingExtension) ExecutionDidStart(ctx context.Context) (context.Context, graphql.ExecutionFinishFunc) {
+	return ctx, func(*graphql.Result) {}
+}
+
+func (tracingExtension) ResolveFieldDidStart(ctx context.Context, i *graphql.ResolveInfo) (context.Context, graphql.ResolveFieldFinishFunc) {
+	return ctx, func(interface{}, error) {} // see tracingInstrument, it takes into account thunks
+}
+
+func (tracingExtension) HasResult() bool { return false }
+
+func (tracingExtension) GetResult(context.Context) interface{} { return nil }
+
+// bufferedResponse keeps response to be patched before sending
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
+
+func (b *bufferedResponse) WriteHeader(status int) { b.status = status }
+
+func wantsTracing(r *http.Request) bool {
+	return r.Header.Get("X-Apollo-Tracing") != "" && (config.Env != "production" || config.ApolloTracing)
+}
+
+// withTracing calls next with tracer in context and adds extensions.tracing to its json response
+func withTracing(w http.ResponseWriter, r *http.Request, next func(w http.ResponseWriter, r *http.Request)) {
+	t := &tracer{start: time.Now()}
+	b := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+	next(b, r.WithContext(context.WithValue(r.Context(), tracingKey{}, t)))
+	body := b.body.Bytes()
+	var response map[string]json.RawMessage
+	if json.Unmarshal(body, &response) == nil { // not json (GraphiQL page, cbor...) is passed as is
+		extensions := map[string]interface{}{}
+		if raw, ok := response["extensions"]; ok {
+			json.Unmarshal(raw, &extensions)
+		}
+		extensions["tracing"] = t.result()
+		if raw, err := json.Marshal(extensions); err == nil {
+			response["extensions"] = raw
+			if patched, err := negotiateEncoding(r).marshal(response); err == nil {
+				body = patched
+			}
+		}
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(b.status)
+	w.Write(body)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTracingSQLHasNoValues(t *testing.T) {
+	tr := &tracer{}
+	ctx := context.WithValue(context.Background(), tracingKey{}, tr)
+	_, done := tracingInstrument.SQL(ctx, "select * from Customer where name like 'secret%' and customer_id in (100, 200)")
+	done(2, nil)
+	if len(tr.sql) != 1 {
+		t.Fatalf("%d statements traced, want 1", len(tr.sql))
+	}
+	if q := tr.sql[0].Query; strings.Contains(q, "secret") || strings.Contains(q, "100") {
+		t.Errorf("values are traced: %s", q)
+	}
+}
+
+func TestWantsTracing(t *testing.T) {
+	prev := *config
+	t.Cleanup(func() { *config = prev })
+	r := httptest.NewRequest("POST", "/gql", nil)
+	r.Header.Set("X-Apollo-Tracing", "1")
+	for _, c := range []struct {
+		env     string
+		allowed bool
+		want    bool
+	}{
+		{"development", false, true},
+		{"production", false, false},
+		{"production", true, true},
+	} {
+		config.Env, config.ApolloTracing = c.env, c.allowed
+		if got := wantsTracing(r); got != c.want {
+			t.Errorf("env %s, apollo_tracing %v: wantsTracing = %v, want %v", c.env, c.allowed, got, c.want)
+		}
+	}
+	config.Env = "development"
+	if wantsTracing(httptest.NewRequest("POST", "/gql", nil)) {
+		t.Error("tracing without header")
+	}
+}